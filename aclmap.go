@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// aclMapEntry is the ACL of the files matching a pattern of Config.ACLMap.
+type aclMapEntry struct {
+	pattern string
+	rules   []string
+	acl     []storage.ACLRule
+}
+
+// parseACLMap parses the ACL of every pattern of m. The entries are
+// sorted from the most specific pattern, the longest, to the least.
+func parseACLMap(m map[string][]string) ([]aclMapEntry, error) {
+	entries := make([]aclMapEntry, 0, len(m))
+
+	for pattern, rules := range m {
+		if err := validatePattern(strings.TrimSuffix(pattern, "/")); err != nil {
+			return nil, errors.Wrap(err, "invalid ACL map pattern")
+		}
+
+		acl, err := parseACLs(rules)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "ACL map %s", pattern)
+		}
+
+		entries = append(entries, aclMapEntry{pattern: pattern, rules: rules, acl: acl})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if len(entries[i].pattern) != len(entries[j].pattern) {
+			return len(entries[i].pattern) > len(entries[j].pattern)
+		}
+
+		return entries[i].pattern < entries[j].pattern
+	})
+
+	return entries, nil
+}
+
+// aclRules returns the entity:role rules and ACL of the object uploaded
+// from file: those of the most specific p.ACLMap pattern matching its path
+// relative to p.Source, p.ACL when none does.
+func (p *Plugin) aclRules(file string) ([]string, []storage.ACLRule) {
+	rel, err := filepath.Rel(p.Config.Source, file)
+
+	if err != nil {
+		return p.Config.ACL, p.acl
+	}
+
+	for _, e := range p.aclMap {
+		if matchAny([]string{e.pattern}, rel) {
+			return e.rules, e.acl
+		}
+	}
+
+	return p.Config.ACL, p.acl
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Annotation formats understood by the annotations option.
+const (
+	annotationsAuto    = "auto"
+	annotationsGitHub  = "github"
+	annotationsHarness = "harness"
+)
+
+// annotationFormat resolves the annotation format to emit.
+// In auto mode the CI system is detected from the environment
+// and an empty string is returned when it cannot be determined.
+func annotationFormat(format string) string {
+	if format != annotationsAuto {
+		return format
+	}
+
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return annotationsGitHub
+	case os.Getenv("DRONE_OUTPUT") != "":
+		return annotationsHarness
+	}
+
+	return ""
+}
+
+// validAnnotationFormat reports whether format is a known annotation format.
+func validAnnotationFormat(format string) bool {
+	switch format {
+	case "", annotationsAuto, annotationsGitHub, annotationsHarness:
+		return true
+	}
+
+	return false
+}
+
+// annotate writes the machine-readable summary of an upload
+// in the format selected by p.Annotations.
+//
+// GitHub annotations are workflow commands written to stdout.
+// Harness output variables are appended to the file named by DRONE_OUTPUT.
+func (p *Plugin) annotate(bucket string, uploaded int) error {
+	switch annotationFormat(p.Config.Annotations) {
+	case annotationsGitHub:
+		_, err := fmt.Fprintf(p.stdout, "::notice title=gcs::uploaded %d files to gs://%s/%s\n", uploaded, bucket, p.Config.Target)
+		return err
+	case annotationsHarness:
+		f, err := os.OpenFile(os.Getenv("DRONE_OUTPUT"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(f, "UPLOADED_FILES=%d\n", uploaded)
+		fmt.Fprintf(f, "UPLOAD_TARGET=gs://%s/%s\n", bucket, p.Config.Target)
+
+		return f.Close()
+	}
+
+	return nil
+}
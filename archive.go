@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of the archive the files are uploaded as.
+const (
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+)
+
+// archiveContentTypes are the content types of the archive objects by format.
+var archiveContentTypes = map[string]string{
+	archiveTarGz: "application/gzip",
+	archiveZip:   "application/zip",
+}
+
+// execArchive uploads the files of src as a single archive named by the target.
+func (p *Plugin) execArchive(src []string) error {
+	if p.Config.Target == "" {
+		return errors.New("target must name the archive object")
+	}
+
+	uploads := make([]upload, 0, len(src))
+
+	for _, f := range src {
+		rel, err := filepath.Rel(p.Config.Source, f)
+
+		if err != nil {
+			return err
+		}
+
+		uploads = append(uploads, upload{file: f, rel: rel, object: p.Config.Target})
+	}
+
+	if err := p.uploadArchive(context.Background(), p.Config.Target, uploads); err != nil {
+		return errors.Wrap(err, "error uploading archive")
+	}
+
+	p.printf("%s: %d files", p.Config.Target, len(uploads))
+	p.summary.Uploaded++
+	return nil
+}
+
+// uploadArchive uploads the files of uploads as a single archive,
+// in p.Archive format, to the object dst. The entries are named
+// by the paths of the files relative to p.Source.
+//
+// The archive is streamed to the object as it is written,
+// so that it is never held in memory or on disk.
+func (p *Plugin) uploadArchive(ctx context.Context, dst string, uploads []upload) error {
+	if p.Config.DryRun {
+		p.printf("DRY-RUN archive %d files to %s", len(uploads), dst)
+		return nil
+	}
+
+	// cancelled rather than closing the writer on error,
+	// which would upload the truncated archive
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(p.writeArchive(pw, uploads))
+	}()
+
+	w := p.newWriter(ctx, dst, "")
+	w.ContentType = archiveContentTypes[p.Config.Archive]
+
+	if _, err := io.Copy(w, pr); err != nil {
+		pr.CloseWithError(err)
+		cancel()
+		return err
+	}
+
+	return w.Close()
+}
+
+// writeArchive writes the archive of the files of uploads to w.
+func (p *Plugin) writeArchive(w io.Writer, uploads []upload) error {
+	if p.Config.Archive == archiveZip {
+		zw := zip.NewWriter(w)
+
+		for _, u := range uploads {
+			if err := addZipEntry(zw, u); err != nil {
+				return errors.Wrapf(err, "error archiving %s", u.rel)
+			}
+		}
+
+		return zw.Close()
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, u := range uploads {
+		if err := addTarEntry(tw, u); err != nil {
+			return errors.Wrapf(err, "error archiving %s", u.rel)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// addTarEntry writes the file of u to tw as the entry u.rel.
+func addTarEntry(tw *tar.Writer, u upload) error {
+	f, err := os.Open(u.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(u.rel)
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// addZipEntry writes the file of u to zw as the entry u.rel.
+func addZipEntry(zw *zip.Writer, u upload) error {
+	f, err := os.Open(u.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(u.rel)
+	hdr.Method = zip.Deflate
+
+	ew, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ew, f)
+	return err
+}
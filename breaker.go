@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errBucketUnavailable is returned by retryUpload once the breaker
+// has tripped, without attempting the upload.
+var errBucketUnavailable = errors.New("bucket appears unavailable")
+
+// breaker aborts the uploads of a run once more than limit attempts
+// in a row failed with a retryable error, cancelling the context of
+// the uploads in flight. A nil breaker never trips.
+type breaker struct {
+	mu       sync.Mutex
+	limit    int
+	failures int  // consecutive failed attempts
+	open     bool // tripped
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// newBreaker returns the breaker of p.MaxRetriesPerBucket,
+// nil when it is not set.
+func (p *Plugin) newBreaker() *breaker {
+	if p.Config.MaxRetriesPerBucket <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &breaker{limit: p.Config.MaxRetriesPerBucket, ctx: ctx, cancel: cancel}
+}
+
+// context returns the context of the uploads, cancelled once b trips.
+func (b *breaker) context() context.Context {
+	if b == nil {
+		return context.Background()
+	}
+
+	return b.ctx
+}
+
+// record counts the outcome of an upload attempt, a success resetting
+// the failures, and reports whether the attempt failed as b tripped,
+// now or before, cancelling it if it was in flight.
+func (b *breaker) record(err error) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := err != nil && (retryable(err) || errors.Is(err, context.Canceled))
+
+	switch {
+	case err == nil:
+		b.failures = 0
+	case failed:
+		b.failures++
+	}
+
+	if b.failures > b.limit {
+		b.open = true
+		b.cancel()
+	}
+
+	return failed && b.open
+}
+
+// stop releases the context of b once the uploads are done.
+func (b *breaker) stop() {
+	if b != nil {
+		b.cancel()
+	}
+}
+
+// tripped reports whether b aborted the uploads.
+func (b *breaker) tripped() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.open
+}
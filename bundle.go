@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// bundle is a tar.gz file the downloaded objects are written to.
+type bundle struct {
+	file *os.File
+	gz   *gzip.Writer
+	tw   *tar.Writer
+}
+
+// createBundle creates the bundle file name, along with its parent directories.
+func createBundle(name string) (*bundle, error) {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "error creating directories")
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating bundle file")
+	}
+
+	gz := gzip.NewWriter(file)
+
+	return &bundle{file: file, gz: gz, tw: tar.NewWriter(gz)}, nil
+}
+
+// add writes the content of an object to the bundle as the entry name.
+func (b *bundle) add(name string, attrs *storage.ObjectAttrs, content []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(content)),
+		ModTime:  attrs.Updated,
+	}
+
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "error writing bundle entry")
+	}
+
+	if _, err := b.tw.Write(content); err != nil {
+		return errors.Wrap(err, "error writing bundle entry")
+	}
+
+	return nil
+}
+
+// Close flushes the bundle and closes its file.
+func (b *bundle) Close() error {
+	err := b.tw.Close()
+
+	if gzErr := b.gz.Close(); err == nil {
+		err = gzErr
+	}
+
+	if fileErr := b.file.Close(); err == nil {
+		err = fileErr
+	}
+
+	return err
+}
+
+// bundleName returns the name of the bundle entry of an object,
+// relative to p.Source when p.DownloadBundleStrip is set.
+func (p *Plugin) bundleName(name string) string {
+	if !p.Config.DownloadBundleStrip {
+		return name
+	}
+
+	return strings.TrimPrefix(name, strings.TrimSuffix(p.Config.Source, "/")+"/")
+}
+
+// bundleObject adds an object to the bundle b.
+//
+// The object is read in memory first since its size is unknown
+// until then when it is decompressed on download.
+func (p *Plugin) bundleObject(ctx context.Context, b *bundle, objAttrs *storage.ObjectAttrs) error {
+	reader, err := p.openObject(ctx, objAttrs.Name)
+	if err != nil {
+		return errors.Wrap(err, "error opening GCS object for reading")
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "error reading GCS object contents")
+	}
+
+	return b.add(p.bundleName(objAttrs.Name), objAttrs, content)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// maxComposeSources is the largest number of objects GCS composes at once.
+const maxComposeSources = 32
+
+// partsCleanupTimeout bounds the deletion of the parts of a composed object.
+const partsCleanupTimeout = time.Minute
+
+// execCompose uploads the files of src, in walk order, as the parts
+// of the object named by the target, composed once all are uploaded.
+// The parts are temporary objects under a prefix unique to the run,
+// deleted afterwards. With p.DeleteSource the files are removed once
+// the object is composed.
+func (p *Plugin) execCompose(src []string) error {
+	if p.Config.Target == "" {
+		return errors.New("target must name the composed object")
+	}
+
+	if len(src) == 0 {
+		return errors.New("no files to compose")
+	}
+
+	if len(src) > maxComposeSources {
+		return errors.Errorf("cannot compose %d files, GCS composes at most %d objects", len(src), maxComposeSources)
+	}
+
+	dst := p.Config.Target
+
+	if p.Config.DryRun {
+		p.printf("DRY-RUN compose %d files to %s", len(src), dst)
+		return nil
+	}
+
+	ctx := p.breaker.context()
+	parts := make([]*storage.ObjectHandle, 0, len(src))
+	prefix := path.Join(path.Dir(dst), fmt.Sprintf(".compose-%016x", rand.Uint64()))
+
+	// the parts uploaded so far are removed whatever happens,
+	// even once the uploads are cancelled by the breaker
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), partsCleanupTimeout)
+		defer cancel()
+
+		for _, part := range parts {
+			if err := part.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				p.printf("warning: error deleting part %s: %v", part.ObjectName(), err)
+			}
+		}
+	}()
+
+	var size int64
+
+	for i, file := range src {
+		name := fmt.Sprintf("%s/part-%d", prefix, i)
+
+		var n int64
+		err := p.retry(name, func() (err error) {
+			n, err = p.uploadPart(ctx, name, file)
+			return err
+		})
+
+		if err != nil {
+			rel, _ := filepath.Rel(p.Config.Source, file)
+			return errors.Wrapf(err, "error uploading part %s", rel)
+		}
+
+		parts = append(parts, p.bucket.Object(name))
+		size += n
+	}
+
+	o := p.bucket.Object(dst)
+
+	if p.Config.NoClobber {
+		o = o.If(storage.Conditions{DoesNotExist: true})
+	}
+
+	c := o.ComposerFrom(parts...)
+	p.setObjectAttrs(&c.ObjectAttrs, dst)
+	c.ContentType = p.contentType(dst)
+
+	if _, err := c.Run(ctx); err != nil {
+		var gerr *googleapi.Error
+		if p.Config.NoClobber && errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			p.printf("%s: skipped, %v", dst, errExists)
+			p.summary.Skipped++
+			return nil
+		}
+
+		return errors.Wrapf(err, "error composing %s", dst)
+	}
+
+	p.printf("%s: composed from %d files", dst, len(src))
+	p.summary.Uploaded++
+	p.summary.Bytes += size
+
+	if p.Config.DeleteSource {
+		p.deleteSources(src)
+	}
+
+	return nil
+}
+
+// deleteSources removes the files of src, composed into the object,
+// and with p.PruneEmptyDirs the directories left empty.
+func (p *Plugin) deleteSources(src []string) {
+	var deleted []string
+
+	for _, file := range src {
+		if err := os.Remove(file); err != nil {
+			p.printf("warning: %v", err)
+			continue
+		}
+
+		deleted = append(deleted, file)
+	}
+
+	if p.Config.PruneEmptyDirs {
+		p.pruneEmptyDirs(deleted)
+	}
+}
+
+// uploadPart uploads the content of file, as is, to the object name.
+// It returns the number of bytes uploaded.
+func (p *Plugin) uploadPart(ctx context.Context, name, file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// cancelled rather than closing the writer on error,
+	// which would upload the partial part
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := p.bucket.Object(name).NewWriter(ctx)
+	n, err := io.Copy(w, f)
+
+	if err != nil {
+		cancel()
+		return n, err
+	}
+
+	return n, w.Close()
+}
@@ -4,10 +4,12 @@ go 1.22.7
 
 require (
 	cloud.google.com/go/storage v1.31.0
+	github.com/andybalholm/brotli v1.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/urfave/cli v1.22.14
 	golang.org/x/net v0.23.0
 	golang.org/x/oauth2 v0.10.0
+	golang.org/x/text v0.14.0
 	google.golang.org/api v0.132.0
 )
 
@@ -29,7 +31,6 @@ require (
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/sync v0.6.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20230717213848-3f92550aa753 // indirect
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// errUnexpectedHash is returned by checkHash when a file does not match
+// the expected hashes. It is never retried.
+var errUnexpectedHash = errors.New("file does not match the expected hashes")
+
+// readExpectedHashes reads a manifest of expected SHA-256 hashes by object
+// name, made of "name sha256" lines. Blank lines and lines starting with #
+// are skipped.
+func readExpectedHashes(manifest string) (map[string]string, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading expected hashes")
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	s := bufio.NewScanner(f)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 || len(fields[1]) != 64 {
+			return nil, errors.Errorf("%s:%d: invalid expected hash, want name sha256", manifest, n)
+		}
+
+		hashes[fields[0]] = strings.ToLower(fields[1])
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading expected hashes")
+	}
+
+	return hashes, nil
+}
+
+// checkHash returns an error unless the SHA-256 of file is the one
+// expected for the object name. Every object is expected to be listed.
+func (p *Plugin) checkHash(name, file string) error {
+	want, ok := p.expectedHashes[name]
+
+	if !ok {
+		return errors.Wrapf(errUnexpectedHash, "%s is not listed", name)
+	}
+
+	got, err := fileHash(file)
+
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return errors.Wrapf(errUnexpectedHash, "sha256 of %s is %s, want %s", name, got, want)
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadIgnorePatterns returns the comma separated patterns of inline
+// followed by those of the file, one per line. Blank lines and lines
+// starting with # are skipped.
+func loadIgnorePatterns(inline, file string) ([]string, error) {
+	patterns := splitPatterns(inline)
+
+	if file == "" {
+		return patterns, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading ignore file")
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading ignore file")
+	}
+
+	return patterns, nil
+}
+
+// shouldIgnoreFile reports whether the file at rel, relative to the source,
+// matches one of the ignore patterns.
+func (p *Plugin) shouldIgnoreFile(rel string) bool {
+	return matchFile(p.ignore, p.ignorePath(rel))
+}
+
+// ignorePath returns the path the ignore patterns are matched against
+// for the file at rel, relative to the source: its path relative to
+// p.IgnoreBase when set, rel itself otherwise.
+func (p *Plugin) ignorePath(rel string) string {
+	if p.Config.IgnoreBase == "" {
+		return rel
+	}
+
+	r, err := filepath.Rel(p.Config.IgnoreBase, filepath.Join(p.Config.Source, rel))
+
+	if err != nil {
+		return rel
+	}
+
+	return r
+}
+
+// shouldIncludeFile reports whether the file at rel, relative to the source,
+// matches one of the include patterns. Every file is included when there
+// are no include patterns.
+func (p *Plugin) shouldIncludeFile(rel string) bool {
+	return len(p.include) == 0 || matchFile(p.include, rel)
+}
+
+// matchFile reports whether the file at rel matches one of patterns,
+// matched against the whole of rel, as ignore patterns always were.
+// Patterns ending with a slash match the directories of rel instead,
+// and so every file under them. See matchPattern for the pattern syntax.
+func matchFile(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if matchAny([]string{pattern}, rel) {
+				return true
+			}
+
+			continue
+		}
+
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAny reports whether rel matches one of patterns.
+//
+// A pattern also matches the files under the directories it matches.
+// Patterns ending with a slash only match directories.
+// See matchPattern for the pattern syntax.
+func matchAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range patterns {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+
+		name := rel
+
+		if dirOnly {
+			name = path.Dir(rel)
+		}
+
+		for ; name != "." && name != "/"; name = path.Dir(name) {
+			if matchPattern(pattern, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchPattern reports whether the slash separated name matches pattern.
+//
+// The pattern syntax is that of path.Match, applied to each path segment,
+// with the addition of a ** segment matching zero or more segments:
+// build/**/*.map matches build/app.map and build/js/vendor/app.map,
+// and of braces matching any of their comma separated alternatives:
+// dist/{js,css}/* matches dist/js/app.js and dist/css/site.css.
+func matchPattern(pattern, name string) bool {
+	for _, p := range expandBraces(pattern) {
+		if matchSegments(strings.Split(p, "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expandBraces returns the patterns obtained by replacing every brace
+// group of pattern with each of its alternatives, nested groups included.
+// An unmatched brace is kept as is.
+func expandBraces(pattern string) []string {
+	start := strings.IndexByte(pattern, '{')
+
+	if start < 0 {
+		return []string{pattern}
+	}
+
+	// split the group at the commas outside of nested groups
+	var alternatives []string
+	depth, last := 0, start+1
+
+	for i := start + 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			alternatives = append(alternatives, pattern[last:i])
+
+			var expanded []string
+
+			for _, rest := range expandBraces(pattern[i+1:]) {
+				for _, alt := range alternatives {
+					for _, a := range expandBraces(alt) {
+						expanded = append(expanded, pattern[:start]+a+rest)
+					}
+				}
+			}
+
+			return expanded
+		}
+	}
+
+	// no closing brace, the opening one is literal
+	var expanded []string
+
+	for _, rest := range expandBraces(pattern[start+1:]) {
+		expanded = append(expanded, pattern[:start+1]+rest)
+	}
+
+	return expanded
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// splitPatterns returns the non-empty patterns of the comma separated list.
+// The commas of brace groups, like {js,css}, do not separate patterns.
+func splitPatterns(list string) []string {
+	var patterns []string
+
+	add := func(pattern string) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	depth, last := 0, 0
+
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				add(list[last:i])
+				last = i + 1
+			}
+		}
+	}
+
+	add(list[last:])
+
+	return patterns
+}
@@ -3,6 +3,7 @@ package gcp
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"golang.org/x/oauth2"
 	"google.golang.org/api/iamcredentials/v1"
@@ -15,14 +16,18 @@ const (
 	scopeURL       = "https://www.googleapis.com/auth/cloud-platform"
 )
 
-func GetFederalToken(idToken, projectNumber, poolId, providerId string) (string, error) {
+// GetFederalToken exchanges the OIDC idToken for a federated access token.
+// The audience is that of the workload identity provider unless set.
+func GetFederalToken(idToken, projectNumber, poolId, providerId, audience string, opts ...option.ClientOption) (*oauth2.Token, error) {
 	ctx := context.Background()
-	stsService, err := sts.NewService(ctx, option.WithoutAuthentication())
+	stsService, err := sts.NewService(ctx, append([]option.ClientOption{option.WithoutAuthentication()}, opts...)...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	audience := fmt.Sprintf(audienceFormat, projectNumber, poolId, providerId)
+	if audience == "" {
+		audience = fmt.Sprintf(audienceFormat, projectNumber, poolId, providerId)
+	}
 
 	tokenRequest := &sts.GoogleIdentityStsV1ExchangeTokenRequest{
 		GrantType:          "urn:ietf:params:oauth:grant-type:token-exchange",
@@ -35,30 +40,144 @@ func GetFederalToken(idToken, projectNumber, poolId, providerId string) (string,
 
 	tokenResponse, err := stsService.V1.Token(tokenRequest).Do()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	token := &oauth2.Token{AccessToken: tokenResponse.AccessToken}
+	if tokenResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
 	}
 
-	return tokenResponse.AccessToken, nil
+	return token, nil
 }
 
-func GetGoogleCloudAccessToken(federatedToken string, serviceAccountEmail string) (string, error) {
+// GetGoogleCloudAccessToken exchanges the federated token for an access token
+// of the service account with scopes, cloud-platform when empty.
+func GetGoogleCloudAccessToken(federatedToken string, serviceAccountEmail string, scopes []string, opts ...option.ClientOption) (*oauth2.Token, error) {
+	if len(scopes) == 0 {
+		scopes = []string{scopeURL}
+	}
+
 	ctx := context.Background()
-	token := &oauth2.Token{AccessToken: federatedToken}
-	service, err := iamcredentials.NewService(ctx, option.WithTokenSource(oauth2.StaticTokenSource(token)))
+	// the federated token is set on the request, a token source option
+	// would be ignored along with an HTTP client option of opts
+	service, err := iamcredentials.NewService(ctx, append([]option.ClientOption{option.WithoutAuthentication()}, opts...)...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	return generateAccessToken(service, serviceAccountEmail, scopes, "Bearer "+federatedToken)
+}
+
+// generateAccessToken generates an access token of the service account,
+// with scopes, using the credentials of service or those of the
+// authorization header when set.
+func generateAccessToken(service *iamcredentials.Service, serviceAccountEmail string, scopes []string, authorization string) (*oauth2.Token, error) {
 	name := "projects/-/serviceAccounts/" + serviceAccountEmail
 	// rb (request body) specifies parameters for generating an access token.
 	rb := &iamcredentials.GenerateAccessTokenRequest{
-		Scope: []string{scopeURL},
+		Scope: scopes,
 	}
 	// Generate an access token for the service account using the specified parameters
-	resp, err := service.Projects.ServiceAccounts.GenerateAccessToken(name, rb).Do()
+	call := service.Projects.ServiceAccounts.GenerateAccessToken(name, rb)
+	if authorization != "" {
+		call.Header().Set("Authorization", authorization)
+	}
+
+	resp, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken := &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer"}
+	if expiry, err := time.Parse(time.RFC3339, resp.ExpireTime); err == nil {
+		accessToken.Expiry = expiry
+	}
+
+	return accessToken, nil
+}
+
+// oidcTokenSource exchanges an OIDC token for an access token
+// of a service account on every call.
+type oidcTokenSource struct {
+	idToken, projectNumber, poolId, providerId, audience string
+	serviceAccountEmail                                  string
+	scopes                                               []string
+	opts                                                 []option.ClientOption
+}
+
+// Token returns a new access token, expiring with the earliest of
+// the federated token and the service account token.
+func (s *oidcTokenSource) Token() (*oauth2.Token, error) {
+	federalToken, err := GetFederalToken(s.idToken, s.projectNumber, s.poolId, s.providerId, s.audience, s.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC token retrieval failed: %w", err)
+	}
+
+	token, err := GetGoogleCloudAccessToken(federalToken.AccessToken, s.serviceAccountEmail, s.scopes, s.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting Google Cloud Access Token: %w", err)
+	}
+
+	if !federalToken.Expiry.IsZero() && (token.Expiry.IsZero() || federalToken.Expiry.Before(token.Expiry)) {
+		token.Expiry = federalToken.Expiry
+	}
+
+	return token, nil
+}
+
+// NewTokenSource returns a token source of access tokens of the service
+// account with scopes, exchanged for the OIDC idToken. A first token is
+// exchanged right away, so that errors are reported early, and a new one
+// when it expires.
+func NewTokenSource(idToken, projectNumber, poolId, providerId, audience, serviceAccountEmail string, scopes []string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	src := &oidcTokenSource{
+		idToken:             idToken,
+		projectNumber:       projectNumber,
+		poolId:              poolId,
+		providerId:          providerId,
+		audience:            audience,
+		serviceAccountEmail: serviceAccountEmail,
+		scopes:              scopes,
+		opts:                opts,
+	}
+
+	token, err := src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.ReuseTokenSource(token, src), nil
+}
+
+// impersonatedTokenSource generates access tokens of a service account
+// with the credentials of service.
+type impersonatedTokenSource struct {
+	service             *iamcredentials.Service
+	serviceAccountEmail string
+	scopes              []string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	token, err := generateAccessToken(s.service, s.serviceAccountEmail, s.scopes, "")
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s failed: %w", s.serviceAccountEmail, err)
+	}
+
+	return token, nil
+}
+
+// ImpersonateTokenSource returns a token source of access tokens of the
+// service account with scopes, generated with the base credentials of
+// opts, or the application default credentials when opts set none.
+// The base credentials need the cloud-platform scope. A new token is
+// generated when it expires.
+func ImpersonateTokenSource(ctx context.Context, serviceAccountEmail string, scopes []string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	service, err := iamcredentials.NewService(ctx, opts...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return resp.AccessToken, nil
+	src := &impersonatedTokenSource{service: service, serviceAccountEmail: serviceAccountEmail, scopes: scopes}
+	return oauth2.ReuseTokenSource(nil, src), nil
 }
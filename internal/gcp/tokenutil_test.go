@@ -0,0 +1,194 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+func TestGetFederalTokenAudience(t *testing.T) {
+	tests := []struct {
+		audience string
+		want     string
+	}{
+		{"", "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"},
+		{"//iam.googleapis.com/custom", "//iam.googleapis.com/custom"},
+	}
+
+	for _, tt := range tests {
+		var req map[string]string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("decoding STS request: %v", err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "federated"}`)
+		}))
+
+		token, err := GetFederalToken("id-token", "123", "pool", "provider", tt.audience, option.WithEndpoint(srv.URL+"/"))
+		srv.Close()
+		if err != nil {
+			t.Fatalf("GetFederalToken: %v", err)
+		}
+
+		if token.AccessToken != "federated" {
+			t.Errorf("token = %q; want federated", token.AccessToken)
+		}
+		if req["audience"] != tt.want {
+			t.Errorf("audience %q: STS request audience = %q; want %q", tt.audience, req["audience"], tt.want)
+		}
+		if req["subjectToken"] != "id-token" {
+			t.Errorf("STS request subject token = %q; want id-token", req["subjectToken"])
+		}
+	}
+}
+
+func TestTokenSourceRefresh(t *testing.T) {
+	var exchanges int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+			// the first federated token is about to expire
+			expiresIn := 1
+			if exchanges > 0 {
+				expiresIn = 3600
+			}
+			fmt.Fprintf(w, `{"access_token": "federated", "expires_in": %d}`, expiresIn)
+			return
+		}
+		exchanges++
+		expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+		fmt.Fprintf(w, `{"accessToken": "access-%d", "expireTime": %q}`, exchanges, expiry)
+	}))
+	defer srv.Close()
+
+	src, err := NewTokenSource("id-token", "123", "pool", "provider", "", "sa@project.iam.gserviceaccount.com", nil, option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatalf("NewTokenSource: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := src.Token()
+		if err != nil {
+			t.Fatalf("Token %d: %v", i, err)
+		}
+		if token.AccessToken != "access-2" {
+			t.Errorf("Token %d = %q; want access-2", i, token.AccessToken)
+		}
+	}
+	if exchanges != 2 {
+		t.Errorf("exchanges = %d; want 2", exchanges)
+	}
+}
+
+func TestTokenSourceScopes(t *testing.T) {
+	var req struct{ Scope []string }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+			fmt.Fprint(w, `{"access_token": "federated", "expires_in": 3600}`)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+		fmt.Fprintf(w, `{"accessToken": "access", "expireTime": %q}`, expiry)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		scopes []string
+		want   []string
+	}{
+		{nil, []string{scopeURL}},
+		{[]string{"https://www.googleapis.com/auth/devstorage.read_only"}, []string{"https://www.googleapis.com/auth/devstorage.read_only"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewTokenSource("id-token", "123", "pool", "provider", "", "sa@project.iam.gserviceaccount.com", tt.scopes, option.WithEndpoint(srv.URL+"/")); err != nil {
+			t.Fatalf("NewTokenSource: %v", err)
+		}
+		if !reflect.DeepEqual(req.Scope, tt.want) {
+			t.Errorf("scopes %q: IAM request scopes = %q; want %q", tt.scopes, req.Scope, tt.want)
+		}
+	}
+}
+
+func TestTokenSourceHTTPClient(t *testing.T) {
+	var auth string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+			fmt.Fprint(w, `{"access_token": "federated", "expires_in": 3600}`)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+		fmt.Fprintf(w, `{"accessToken": "access", "expireTime": %q}`, expiry)
+	}))
+	defer srv.Close()
+
+	// only the client of the server trusts its certificate
+	src, err := NewTokenSource("id-token", "123", "pool", "provider", "", "sa@project.iam.gserviceaccount.com", nil,
+		option.WithEndpoint(srv.URL+"/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("NewTokenSource: %v", err)
+	}
+
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "access" {
+		t.Errorf("token = %q; want access", token.AccessToken)
+	}
+	if auth != "Bearer federated" {
+		t.Errorf("IAM request authorization = %q; want Bearer federated", auth)
+	}
+}
+
+func TestImpersonateTokenSource(t *testing.T) {
+	var auth, path string
+	var req struct{ Scope []string }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, path = r.Header.Get("Authorization"), r.URL.Path
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+		fmt.Fprintf(w, `{"accessToken": "impersonated", "expireTime": %q}`, expiry)
+	}))
+	defer srv.Close()
+
+	base := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base"})
+	src, err := ImpersonateTokenSource(context.Background(), "deploy@project.iam.gserviceaccount.com",
+		[]string{"https://www.googleapis.com/auth/devstorage.read_only"}, option.WithTokenSource(base), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatalf("ImpersonateTokenSource: %v", err)
+	}
+
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	if token.AccessToken != "impersonated" {
+		t.Errorf("token = %q; want impersonated", token.AccessToken)
+	}
+	if want := []string{"https://www.googleapis.com/auth/devstorage.read_only"}; !reflect.DeepEqual(req.Scope, want) {
+		t.Errorf("IAM request scopes = %q; want %q", req.Scope, want)
+	}
+	if auth != "Bearer base" {
+		t.Errorf("IAM request authorization = %q; want Bearer base", auth)
+	}
+	if want := "/v1/projects/-/serviceAccounts/deploy@project.iam.gserviceaccount.com:generateAccessToken"; path != want {
+		t.Errorf("IAM request path = %q; want %q", path, want)
+	}
+}
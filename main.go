@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/drone-plugins/drone-gcs/internal/gcp"
@@ -13,7 +21,9 @@ import (
 	"github.com/urfave/cli"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 var (
@@ -21,6 +31,13 @@ var (
 )
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp returns the command line application running the plugin.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "gcs plugin"
 	app.Usage = "gcs plugin"
@@ -37,6 +54,153 @@ func main() {
 			Usage:  "google json keys",
 			EnvVar: "PLUGIN_JSON_KEY",
 		},
+		cli.BoolFlag{
+			Name:   "allow-empty",
+			Usage:  "succeed with nothing to upload when no file matches or the source is missing, instead of failing",
+			EnvVar: "PLUGIN_ALLOW_EMPTY",
+		},
+		cli.BoolFlag{
+			Name:   "compose",
+			Usage:  "compose the files, in path order, into the single object named by the target",
+			EnvVar: "PLUGIN_COMPOSE",
+		},
+		cli.BoolFlag{
+			Name:   "disable-client-retries",
+			Usage:  "do not let the storage client retry failed requests, only retry uploads as set by retries",
+			EnvVar: "PLUGIN_DISABLE_CLIENT_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "log-hashes",
+			Usage:  "log the CRC32C and MD5 of every uploaded object",
+			EnvVar: "PLUGIN_LOG_HASHES",
+		},
+		cli.BoolFlag{
+			Name:   "progress",
+			Usage:  "log the bytes uploaded and the throughput of each file, and in total",
+			EnvVar: "PLUGIN_PROGRESS",
+		},
+		cli.StringFlag{
+			Name:   "archive",
+			Usage:  "upload the files as a single archive named by the target, in tar.gz or zip format",
+			EnvVar: "PLUGIN_ARCHIVE",
+		},
+		cli.BoolFlag{
+			Name:   "skip-bucket-check",
+			Usage:  "do not check that the target bucket exists before uploading",
+			EnvVar: "PLUGIN_SKIP_BUCKET_CHECK",
+		},
+		cli.BoolFlag{
+			Name:   "create-bucket",
+			Usage:  "create the target bucket when it does not exist",
+			EnvVar: "PLUGIN_CREATE_BUCKET",
+		},
+		cli.StringFlag{
+			Name:   "bucket-location",
+			Usage:  "location of the created bucket, e.g. EU or us-central1",
+			EnvVar: "PLUGIN_BUCKET_LOCATION",
+		},
+		cli.StringFlag{
+			Name:   "project-id",
+			Usage:  "project the bucket is created in",
+			EnvVar: "PLUGIN_PROJECT_ID",
+		},
+		cli.StringFlag{
+			Name:   "temp-dir",
+			Usage:  "directory of the temporary file the JSON key is written to",
+			EnvVar: "PLUGIN_TEMP_DIR",
+		},
+		cli.StringFlag{
+			Name:   "credentials-file",
+			Usage:  "path of a google credentials file",
+			EnvVar: "PLUGIN_CREDENTIALS_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "ordered-log",
+			Usage:  "log the upload results in upload order once all files are uploaded",
+			EnvVar: "PLUGIN_ORDERED_LOG",
+		},
+		cli.BoolFlag{
+			Name:   "sorted-summary",
+			Usage:  "list the upload results sorted by object name once all files are uploaded",
+			EnvVar: "PLUGIN_SORTED_SUMMARY",
+		},
+		cli.StringFlag{
+			Name:   "manifest",
+			Usage:  "name of the object, relative to the target, the manifest of the uploaded objects is written to",
+			EnvVar: "PLUGIN_MANIFEST",
+		},
+		cli.StringFlag{
+			Name:   "manifest-content-type",
+			Usage:  "Content-Type of the manifest object",
+			EnvVar: "PLUGIN_MANIFEST_CONTENT_TYPE",
+			Value:  defaultManifestContentType,
+		},
+		cli.StringFlag{
+			Name:   "generate-index",
+			Usage:  "name of the object, relative to the target, the JSON index of the uploaded objects is written to",
+			EnvVar: "PLUGIN_GENERATE_INDEX",
+		},
+		cli.StringFlag{
+			Name:   "webhook-url",
+			Usage:  "URL the JSON summary of the run is posted to",
+			EnvVar: "PLUGIN_WEBHOOK_URL",
+		},
+		cli.BoolFlag{
+			Name:   "webhook-required",
+			Usage:  "fail the run when the webhook cannot be called",
+			EnvVar: "PLUGIN_WEBHOOK_REQUIRED",
+		},
+		cli.DurationFlag{
+			Name:   "webhook-timeout",
+			Usage:  "time allowed to call the webhook",
+			EnvVar: "PLUGIN_WEBHOOK_TIMEOUT",
+			Value:  defaultWebhookTimeout,
+		},
+		cli.BoolFlag{
+			Name:   "print-config",
+			Usage:  "log the effective configuration, with credentials redacted",
+			EnvVar: "PLUGIN_PRINT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "ca-cert",
+			Usage:  "path or PEM contents of a CA bundle trusted for connections to GCS",
+			EnvVar: "PLUGIN_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "endpoint",
+			Usage:  "GCS JSON API endpoint, e.g. http://localhost:4443/storage/v1/ for an emulator",
+			EnvVar: "PLUGIN_ENDPOINT,STORAGE_EMULATOR_HOST",
+		},
+		cli.BoolFlag{
+			Name:   "insecure-skip-verify",
+			Usage:  "disable TLS certificate verification, for test environments only",
+			EnvVar: "PLUGIN_INSECURE_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "strip-prefix",
+			Usage:  "leading directories stripped from the name of uploaded files",
+			EnvVar: "PLUGIN_STRIP_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:   "flatten",
+			Usage:  "upload all files directly under the target, named after their base name",
+			EnvVar: "PLUGIN_FLATTEN",
+		},
+		cli.StringFlag{
+			Name:   "acl-map",
+			Usage:  `a dictionary of file patterns to ACL rules, e.g. {"public/*": ["allUsers:READER"], "*": []}`,
+			EnvVar: "PLUGIN_ACL_MAP",
+		},
+		cli.BoolFlag{
+			Name:   "acl-sidecars",
+			Usage:  "apply the ACL rules of the nearest .acl sidecar of each file",
+			EnvVar: "PLUGIN_ACL_SIDECARS",
+		},
+		cli.StringFlag{
+			Name:   "predefined-acl",
+			Usage:  "predefined ACL of the uploaded objects, e.g. publicRead",
+			EnvVar: "PLUGIN_PREDEFINED_ACL",
+		},
 		cli.StringSliceFlag{
 			Name:   "acl",
 			Usage:  "a list of access rules applied to the uploaded files, in a form of entity:role",
@@ -49,34 +213,381 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "ignore",
-			Usage:  "skip files matching this pattern, relative to source",
+			Usage:  "skip files matching these comma separated patterns, relative to source, or under directories matching those ending with a slash",
 			EnvVar: "PLUGIN_IGNORE",
 		},
+		cli.StringFlag{
+			Name:   "ignore-file",
+			Usage:  "file of patterns of the files to ignore, one per line",
+			EnvVar: "PLUGIN_IGNORE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "ignore-base",
+			Usage:  "directory the ignore patterns are relative to, the source when empty",
+			EnvVar: "PLUGIN_IGNORE_BASE",
+		},
+		cli.StringFlag{
+			Name:   "rules-file",
+			Usage:  "JSON array of upload rules with their own source, target and options",
+			EnvVar: "PLUGIN_RULES_FILE",
+		},
+		cli.StringFlag{
+			Name:   "include",
+			Usage:  "comma separated patterns of the only files to upload",
+			EnvVar: "PLUGIN_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "trim-prefix",
+			Usage:  "leading path removed from the name of each file, relative to source, before uploading",
+			EnvVar: "PLUGIN_TRIM_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "rename",
+			Usage:  "template of the object names, with {path}, {dir}, {base}, {name} and {ext} tokens",
+			EnvVar: "PLUGIN_RENAME",
+		},
+		cli.BoolFlag{
+			Name:   "trim-prefix-optional",
+			Usage:  "keep the name of files not starting with `trim-prefix` instead of failing",
+			EnvVar: "PLUGIN_TRIM_PREFIX_OPTIONAL",
+		},
+		cli.BoolFlag{
+			Name:   "preserve-mtime",
+			Usage:  "set the modification time of downloaded files to the update time of their object",
+			EnvVar: "PLUGIN_PRESERVE_MTIME",
+		},
+		cli.BoolFlag{
+			Name:   "dedupe-collisions",
+			Usage:  "upload files mapped to the same object once if identical, or with a content hash suffix otherwise",
+			EnvVar: "PLUGIN_DEDUPE_COLLISIONS",
+		},
+		cli.BoolFlag{
+			Name:   "hash-long-names",
+			Usage:  "truncate object names longer than 1024 bytes and suffix them with a hash instead of failing",
+			EnvVar: "PLUGIN_HASH_LONG_NAMES",
+		},
+		cli.BoolFlag{
+			Name:   "skip-unchanged",
+			Usage:  "skip files whose content matches the object already in the bucket",
+			EnvVar: "PLUGIN_SKIP_UNCHANGED",
+		},
+		cli.BoolFlag{
+			Name:   "no-clobber",
+			Usage:  "skip the files whose object already exists instead of overwriting it",
+			EnvVar: "PLUGIN_NO_CLOBBER",
+		},
+		cli.StringFlag{
+			Name:   "symlinks",
+			Usage:  "policy applied to symbolic links under source: skip, follow or error",
+			Value:  symlinksSkip,
+			EnvVar: "PLUGIN_SYMLINKS",
+		},
+		cli.Int64Flag{
+			Name:   "max-file-size",
+			Usage:  "size in bytes above which files are not uploaded, unlimited when zero",
+			EnvVar: "PLUGIN_MAX_FILE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "max-file-size-action",
+			Usage:  "action on files larger than max-file-size: skip or fail",
+			Value:  maxFileSizeSkip,
+			EnvVar: "PLUGIN_MAX_FILE_SIZE_ACTION",
+		},
+		cli.BoolFlag{
+			Name:   "delete-source",
+			Usage:  "remove local files once uploaded, to every target",
+			EnvVar: "PLUGIN_DELETE_SOURCE",
+		},
+		cli.BoolFlag{
+			Name:   "prune-empty-dirs",
+			Usage:  "remove the directories left empty by delete-source",
+			EnvVar: "PLUGIN_PRUNE_EMPTY_DIRS",
+		},
+		cli.BoolFlag{
+			Name:   "continue-on-error",
+			Usage:  "keep uploading the other files when one fails, reporting all failures at the end",
+			EnvVar: "PLUGIN_CONTINUE_ON_ERROR",
+		},
+		cli.BoolFlag{
+			Name:   "skip-vanished",
+			Usage:  "skip files removed from source before they could be uploaded",
+			EnvVar: "PLUGIN_SKIP_VANISHED",
+		},
 		cli.StringFlag{
 			Name:   "target",
-			Usage:  "destination to copy files to, including bucket name",
+			Usage:  "destination to copy files to, including bucket name, comma separated for several",
 			EnvVar: "PLUGIN_TARGET",
 		},
+		cli.StringFlag{
+			Name:   "bucket",
+			Usage:  "bucket name, replacing the one of target, or of source in download mode",
+			EnvVar: "PLUGIN_BUCKET",
+		},
+		cli.StringFlag{
+			Name:   "prefix",
+			Usage:  "prefix of the objects in the bucket set by bucket",
+			EnvVar: "PLUGIN_PREFIX",
+		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			Usage:  "number of files uploaded in parallel",
+			Value:  defaultConcurrency,
+			EnvVar: "PLUGIN_CONCURRENCY",
+		},
+		cli.DurationFlag{
+			Name:   "ramp-up",
+			Usage:  "time over which the upload concurrency grows from one to its maximum",
+			EnvVar: "PLUGIN_RAMP_UP",
+		},
+		cli.IntFlag{
+			Name:   "chunk-size",
+			Usage:  "size in MB of the chunks of resumable uploads, zero to upload files in a single request",
+			Value:  defaultChunkSize,
+			EnvVar: "PLUGIN_CHUNK_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "compress-concurrency",
+			Usage:  "number of files compressed in parallel, unbounded when zero",
+			EnvVar: "PLUGIN_COMPRESS_CONCURRENCY",
+		},
+		cli.BoolFlag{
+			Name:   "sync",
+			Usage:  "delete objects under the target which do not exist in source",
+			EnvVar: "PLUGIN_SYNC",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "log the objects that would be uploaded or deleted without changing the bucket",
+			EnvVar: "PLUGIN_DRY_RUN",
+		},
 		cli.BoolFlag{
 			Name:   "download",
 			Usage:  "switch to download mode, which will fetch `source`'s files from GCS",
 			EnvVar: "PLUGIN_DOWNLOAD",
 		},
+		cli.BoolFlag{
+			Name:   "verify-download-count",
+			Usage:  "keep downloading past failed objects and fail if fewer files than listed objects were written",
+			EnvVar: "PLUGIN_VERIFY_DOWNLOAD_COUNT",
+		},
+		cli.IntFlag{
+			Name:   "retries",
+			Usage:  "number of times a failed upload is retried",
+			EnvVar: "PLUGIN_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "retry-backoff",
+			Usage:  "time waited before the first retry of an upload, doubled for each next one",
+			EnvVar: "PLUGIN_RETRY_BACKOFF",
+			Value:  time.Second,
+		},
+		cli.StringFlag{
+			Name:   "total-retry-budget",
+			Usage:  "retries allowed across all uploads, as a count like 10 or a total backoff like 2m, unlimited when unset",
+			EnvVar: "PLUGIN_TOTAL_RETRY_BUDGET",
+		},
+		cli.IntFlag{
+			Name:   "max-retries-per-bucket",
+			Usage:  "failed upload attempts in a row after which the bucket is deemed unavailable and the run aborted",
+			EnvVar: "PLUGIN_MAX_RETRIES_PER_BUCKET",
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "time allowed for the upload of each file, e.g. 5m",
+			EnvVar: "PLUGIN_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "download-retries",
+			Usage:  "number of times the download of an object reported missing is retried",
+			EnvVar: "PLUGIN_DOWNLOAD_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "expected-hashes",
+			Usage:  "manifest of the SHA-256 expected for every object, as name sha256 lines",
+			EnvVar: "PLUGIN_EXPECTED_HASHES",
+		},
+		cli.StringFlag{
+			Name:   "download-existing",
+			Usage:  "policy applied to existing local files on download: overwrite, skip or fail",
+			EnvVar: "PLUGIN_DOWNLOAD_EXISTING",
+			Value:  downloadOverwrite,
+		},
+		cli.BoolFlag{
+			Name:   "download-compare",
+			Usage:  "only apply the download policy to files of the same size, not older than the object",
+			EnvVar: "PLUGIN_DOWNLOAD_COMPARE",
+		},
+		cli.BoolFlag{
+			Name:   "download-bundle",
+			Usage:  "download the objects into a single tar.gz file named by target",
+			EnvVar: "PLUGIN_DOWNLOAD_BUNDLE",
+		},
+		cli.BoolFlag{
+			Name:   "download-bundle-strip",
+			Usage:  "strip the source prefix from the names of the bundled objects",
+			EnvVar: "PLUGIN_DOWNLOAD_BUNDLE_STRIP",
+		},
+		cli.StringFlag{
+			Name:   "download-template",
+			Usage:  "template of the local path of downloaded objects, relative to target, e.g. {{.Dir}}/{{.Base}}",
+			EnvVar: "PLUGIN_DOWNLOAD_TEMPLATE",
+		},
+		cli.Int64Flag{
+			Name:   "generation",
+			Usage:  "generation of the object to download, when the source is a single object",
+			EnvVar: "PLUGIN_GENERATION",
+		},
+		cli.StringFlag{
+			Name:   "download-filter",
+			Usage:  "comma separated patterns of the objects to download, relative to source",
+			EnvVar: "PLUGIN_DOWNLOAD_FILTER",
+		},
 		cli.StringSliceFlag{
 			Name:   "gzip",
 			Usage:  `files with the specified extensions will be gzipped and uploaded with "gzip" Content-Encoding header`,
 			EnvVar: "PLUGIN_GZIP",
 		},
+		cli.BoolFlag{
+			Name:   "public-url",
+			Usage:  "log the public https URL of every uploaded object",
+			EnvVar: "PLUGIN_PUBLIC_URL",
+		},
+		cli.BoolFlag{
+			Name:   "skip-hidden",
+			Usage:  "skip the files and directories whose name starts with a dot",
+			EnvVar: "PLUGIN_SKIP_HIDDEN",
+		},
+		cli.Int64Flag{
+			Name:   "gzip-min-size",
+			Usage:  "size in bytes under which the files to gzip are uploaded uncompressed",
+			EnvVar: "PLUGIN_GZIP_MIN_SIZE",
+		},
+		cli.StringSliceFlag{
+			Name:   "gzip-content-types",
+			Usage:  "files of the specified content types will be gzipped as well, e.g. application/json",
+			EnvVar: "PLUGIN_GZIP_CONTENT_TYPES",
+		},
+		cli.StringSliceFlag{
+			Name:   "brotli",
+			Usage:  `files with the specified extensions will be brotli compressed and uploaded with "br" Content-Encoding header, taking precedence over gzip`,
+			EnvVar: "PLUGIN_BROTLI",
+		},
+		cli.StringSliceFlag{
+			Name:   "no-gzip-glob",
+			Usage:  "patterns of the files and directories never gzipped, taking precedence over gzip",
+			EnvVar: "PLUGIN_NO_GZIP_GLOB",
+		},
+		cli.BoolFlag{
+			Name:   "verify-gzip",
+			Usage:  "check that gzipped files decompress to their content before they are uploaded",
+			EnvVar: "PLUGIN_VERIFY_GZIP",
+		},
 		cli.StringFlag{
 			Name:   "cache-control",
 			Usage:  "Cache-Control header",
 			EnvVar: "PLUGIN_CACHE_CONTROL",
 		},
+		cli.StringFlag{
+			Name:   "content-disposition",
+			Usage:  "Content-Disposition header, {filename} expands to the object base name",
+			EnvVar: "PLUGIN_CONTENT_DISPOSITION",
+		},
+		cli.StringFlag{
+			Name:   "content-language",
+			Usage:  "Content-Language header, e.g. en-US",
+			EnvVar: "PLUGIN_CONTENT_LANGUAGE",
+		},
+		cli.StringFlag{
+			Name:   "content-type",
+			Usage:  `a dictionary of file extensions to Content-Type, e.g. {"wasm": "application/wasm"}`,
+			EnvVar: "PLUGIN_CONTENT_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "default-content-type",
+			Usage:  "Content-Type of the files of unknown type, application/octet-stream by default",
+			EnvVar: "PLUGIN_DEFAULT_CONTENT_TYPE",
+		},
+		cli.BoolFlag{
+			Name:   "disable-content-type-detection",
+			Usage:  "type every file not listed in content-type with the default content type",
+			EnvVar: "PLUGIN_DISABLE_CONTENT_TYPE_DETECTION",
+		},
+		cli.StringFlag{
+			Name:   "encoding-map",
+			Usage:  `a dictionary of file extensions to Content-Encoding of already encoded files, e.g. {"br": "br"}`,
+			EnvVar: "PLUGIN_ENCODING_MAP",
+		},
+		cli.StringFlag{
+			Name:   "custom-time",
+			Usage:  "custom time of the uploaded objects, an RFC 3339 timestamp or now",
+			EnvVar: "PLUGIN_CUSTOM_TIME",
+		},
+		cli.BoolFlag{
+			Name:   "temporary-hold",
+			Usage:  "place the uploaded objects under a temporary hold",
+			EnvVar: "PLUGIN_TEMPORARY_HOLD",
+		},
+		cli.BoolFlag{
+			Name:   "event-based-hold",
+			Usage:  "place the uploaded objects under an event-based hold",
+			EnvVar: "PLUGIN_EVENT_BASED_HOLD",
+		},
+		cli.StringFlag{
+			Name:   "storage-class",
+			Usage:  "storage class of uploaded objects: STANDARD, NEARLINE, COLDLINE or ARCHIVE",
+			EnvVar: "PLUGIN_STORAGE_CLASS",
+		},
+		cli.StringFlag{
+			Name:   "kms-key",
+			Usage:  "Cloud KMS key used to encrypt uploaded objects, projects/P/locations/L/keyRings/R/cryptoKeys/K",
+			EnvVar: "PLUGIN_KMS_KEY",
+		},
 		cli.StringFlag{
 			Name:   "metadata",
 			Usage:  "an arbitrary dictionary with custom metadata applied to all objects",
 			EnvVar: "PLUGIN_METADATA",
 		},
+		cli.StringFlag{
+			Name:   "gzip-metadata",
+			Usage:  "a dictionary with custom metadata applied only to gzipped objects, on top of `metadata`",
+			EnvVar: "PLUGIN_GZIP_METADATA",
+		},
+		cli.StringFlag{
+			Name:   "gzip-cache-control",
+			Usage:  "Cache-Control header of gzipped objects, overriding `cache-control`",
+			EnvVar: "PLUGIN_GZIP_CACHE_CONTROL",
+		},
+		cli.StringFlag{
+			Name:   "guard-object",
+			Usage:  "name of an object in the target bucket whose existence prevents the upload",
+			EnvVar: "PLUGIN_GUARD_OBJECT",
+		},
+		cli.StringFlag{
+			Name:   "guard-policy",
+			Usage:  "what to do when the guard object exists: skip or fail",
+			Value:  guardSkip,
+			EnvVar: "PLUGIN_GUARD_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "guard-create",
+			Usage:  "create the guard object after a successful upload",
+			EnvVar: "PLUGIN_GUARD_CREATE",
+		},
+		cli.BoolFlag{
+			Name:   "log-durations",
+			Usage:  "log the time taken to upload each file",
+			EnvVar: "PLUGIN_LOG_DURATIONS",
+		},
+		cli.DurationFlag{
+			Name:   "slow-upload-threshold",
+			Usage:  "only log the upload time of files slower than this, e.g. 5s",
+			EnvVar: "PLUGIN_SLOW_UPLOAD_THRESHOLD",
+		},
+		cli.StringFlag{
+			Name:   "annotations",
+			Usage:  "write a summary annotation after upload: github, harness or auto to detect the CI system",
+			EnvVar: "PLUGIN_ANNOTATIONS",
+		},
 		cli.StringFlag{
 			Name:   "oidc-poo-id",
 			Usage:  "OIDC WORKLOAD POOL ID",
@@ -102,32 +613,142 @@ func main() {
 			Usage:  "OIDC GCP Token",
 			EnvVar: "PLUGIN_OIDC_TOKEN_ID",
 		},
+		cli.StringFlag{
+			Name:   "oidc-audience",
+			Usage:  "OIDC token exchange audience, derived from the pool and provider when empty",
+			EnvVar: "PLUGIN_OIDC_AUDIENCE",
+		},
+		cli.StringSliceFlag{
+			Name:   "scopes",
+			Usage:  "OAuth scopes of the token, e.g. https://www.googleapis.com/auth/devstorage.read_only",
+			EnvVar: "PLUGIN_SCOPES",
+		},
+		cli.StringFlag{
+			Name:   "impersonate-service-account",
+			Usage:  "email of a service account to impersonate with the plugin credentials",
+			EnvVar: "PLUGIN_IMPERSONATE_SERVICE_ACCOUNT",
+		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
-	}
+	return app
 }
 
 func run(c *cli.Context) error {
 	plugin := Plugin{
 		Config: Config{
 			Token:               c.String("token"),
+			Endpoint:            c.String("endpoint"),
 			ACL:                 c.StringSlice("acl"),
+			PredefinedACL:       c.String("predefined-acl"),
+			ACLSidecars:         c.Bool("acl-sidecars"),
+			Flatten:             c.Bool("flatten"),
+			StripPrefix:         c.String("strip-prefix"),
 			Source:              c.String("source"),
 			Target:              c.String("target"),
+			Bucket:              c.String("bucket"),
+			Prefix:              c.String("prefix"),
+			Concurrency:         c.Int("concurrency"),
+			CompressConcurrency: c.Int("compress-concurrency"),
+			ChunkSize:           c.Int("chunk-size"),
+			RampUp:              c.Duration("ramp-up"),
+			Sync:                c.Bool("sync"),
+			DryRun:              c.Bool("dry-run"),
 			Download:            c.Bool("download"),
+			DownloadTemplate:    c.String("download-template"),
+			DownloadFilter:      c.String("download-filter"),
+			Generation:          c.Int64("generation"),
+			DownloadBundle:      c.Bool("download-bundle"),
+			DownloadExisting:    c.String("download-existing"),
+			ExpectedHashes:      c.String("expected-hashes"),
+			DownloadCompare:     c.Bool("download-compare"),
+			DownloadBundleStrip: c.Bool("download-bundle-strip"),
+			DownloadRetries:     c.Int("download-retries"),
+			Retries:             c.Int("retries"),
+			RetryBackoff:        c.Duration("retry-backoff"),
+			Timeout:             c.Duration("timeout"),
+			VerifyDownloadCount: c.Bool("verify-download-count"),
 			Ignore:              c.String("ignore"),
+			IgnoreFile:          c.String("ignore-file"),
+			Include:             c.String("include"),
+			RulesFile:           c.String("rules-file"),
+			TrimPrefix:          c.String("trim-prefix"),
+			TrimPrefixOptional:  c.Bool("trim-prefix-optional"),
+			Rename:              c.String("rename"),
+			SkipVanished:        c.Bool("skip-vanished"),
+			ContinueOnError:     c.Bool("continue-on-error"),
+			DeleteSource:        c.Bool("delete-source"),
+			PruneEmptyDirs:      c.Bool("prune-empty-dirs"),
+			NoClobber:           c.Bool("no-clobber"),
+			Symlinks:            c.String("symlinks"),
+			MaxFileSize:         c.Int64("max-file-size"),
+			MaxFileSizeAction:   c.String("max-file-size-action"),
+			SkipUnchanged:       c.Bool("skip-unchanged"),
+			DedupeCollisions:    c.Bool("dedupe-collisions"),
+			PreserveMtime:       c.Bool("preserve-mtime"),
+			HashLongNames:       c.Bool("hash-long-names"),
 			Gzip:                c.StringSlice("gzip"),
+			Brotli:              c.StringSlice("brotli"),
 			CacheControl:        c.String("cache-control"),
+			VerifyGzip:          c.Bool("verify-gzip"),
+			NoGzipGlob:          c.StringSlice("no-gzip-glob"),
+			ContentDisposition:  c.String("content-disposition"),
+			ContentLanguage:     c.String("content-language"),
+			PrintConfig:         c.Bool("print-config"),
+			OrderedLog:          c.Bool("ordered-log"),
+			WebhookURL:          c.String("webhook-url"),
+			Manifest:            c.String("manifest"),
+			ManifestContentType: c.String("manifest-content-type"),
+			GenerateIndex:       c.String("generate-index"),
+			WebhookRequired:     c.Bool("webhook-required"),
+			WebhookTimeout:      c.Duration("webhook-timeout"),
+			GzipCacheControl:    c.String("gzip-cache-control"),
+			StorageClass:        c.String("storage-class"),
+			TemporaryHold:       c.Bool("temporary-hold"),
+			EventBasedHold:      c.Bool("event-based-hold"),
+			KMSKey:              c.String("kms-key"),
+			Annotations:         c.String("annotations"),
+			LogDurations:        c.Bool("log-durations"),
+			SlowUploadThreshold: c.Duration("slow-upload-threshold"),
+			GuardObject:         c.String("guard-object"),
+			GuardPolicy:         c.String("guard-policy"),
+			GuardCreate:         c.Bool("guard-create"),
 			workloadPoolId:      c.String("oidc-poo-id"),
 			providerId:          c.String("oidc-provider-id"),
 			gcpProjectId:        c.String("oidc-project-number"),
 			serviceAccountEmail: c.String("oidc-service-account-email"),
 			OidcIdToken:         c.String("oidc-token-id"),
+			OidcAudience:        c.String("oidc-audience"),
+
+			DefaultContentType:          c.String("default-content-type"),
+			DisableContentTypeDetection: c.Bool("disable-content-type-detection"),
+			ImpersonateServiceAccount:   c.String("impersonate-service-account"),
+			Scopes:                      c.StringSlice("scopes"),
+			CredentialsFile:             c.String("credentials-file"),
+			SkipBucketCheck:             c.Bool("skip-bucket-check"),
+			Archive:                     c.String("archive"),
+			Progress:                    c.Bool("progress"),
+			SortedSummary:               c.Bool("sorted-summary"),
+			GzipContentTypes:            c.StringSlice("gzip-content-types"),
+			GzipMinSize:                 c.Int64("gzip-min-size"),
+			SkipHidden:                  c.Bool("skip-hidden"),
+			PublicURL:                   c.Bool("public-url"),
+			Compose:                     c.Bool("compose"),
+			IgnoreBase:                  c.String("ignore-base"),
+			CreateBucket:                c.Bool("create-bucket"),
+			BucketLocation:              c.String("bucket-location"),
+			ProjectID:                   c.String("project-id"),
+			LogHashes:                   c.Bool("log-hashes"),
+			TempDir:                     c.String("temp-dir"),
+			DisableClientRetries:        c.Bool("disable-client-retries"),
+			AllowEmpty:                  c.Bool("allow-empty"),
+			MaxRetriesPerBucket:         c.Int("max-retries-per-bucket"),
 		},
 	}
 
+	if m := envMetadata(os.Environ()); len(m) > 0 {
+		plugin.Config.Metadata = m
+	}
+
 	if m := c.String("metadata"); m != "" {
 		var metadata map[string]string
 
@@ -135,114 +756,574 @@ func run(c *cli.Context) error {
 			return errors.Wrap(err, "error parsing metadata field")
 		}
 
-		plugin.Config.Metadata = metadata
+		// explicit metadata takes precedence over PLUGIN_META_* variables
+		plugin.Config.Metadata = mergeMetadata(plugin.Config.Metadata, metadata)
+	}
+
+	if m := c.String("acl-map"); m != "" {
+		var acls map[string][]string
+
+		if err := json.Unmarshal([]byte(m), &acls); err != nil {
+			return errors.Wrap(err, "error parsing acl-map field")
+		}
+
+		plugin.Config.ACLMap = acls
+	}
+
+	if m := c.String("content-type"); m != "" {
+		var types map[string]string
+
+		if err := json.Unmarshal([]byte(m), &types); err != nil {
+			return errors.Wrap(err, "error parsing content-type field")
+		}
+
+		plugin.Config.ContentTypeMap = types
 	}
 
-	if !plugin.Config.Download {
-		if plugin.Config.Target == "" {
-			return errors.New("Missing target")
+	if m := c.String("encoding-map"); m != "" {
+		var encodings map[string]string
+
+		if err := json.Unmarshal([]byte(m), &encodings); err != nil {
+			return errors.Wrap(err, "error parsing encoding-map field")
 		}
+
+		plugin.Config.EncodingMap = encodings
 	}
 
-	if plugin.Config.Source == "" {
-		return errors.New("Missing source")
+	if m := c.String("gzip-metadata"); m != "" {
+		var metadata map[string]string
+
+		if err := json.Unmarshal([]byte(m), &metadata); err != nil {
+			return errors.Wrap(err, "error parsing gzip-metadata field")
+		}
+
+		plugin.Config.GzipMetadata = metadata
+	}
+
+	// with a rules file, source and target may be given by every rule
+	if plugin.Config.RulesFile == "" {
+		if !plugin.Config.Download {
+			if plugin.Config.Target == "" && plugin.Config.Bucket == "" {
+				return errors.New("Missing target")
+			}
+		}
+
+		if plugin.Config.Source == "" && (!plugin.Config.Download || plugin.Config.Bucket == "") {
+			return errors.New("Missing source")
+		}
+	}
+
+	if err := validateRename(plugin.Config.Rename); err != nil {
+		return err
+	}
+
+	if n := plugin.Config.ChunkSize; n < 0 || n > maxChunkSize {
+		return errors.Errorf("Invalid chunk size %d, must be between 0 and %d MB", n, maxChunkSize)
+	}
+
+	if plugin.Config.CompressConcurrency < 0 {
+		return errors.Errorf("Invalid compress concurrency %d, must be positive", plugin.Config.CompressConcurrency)
+	}
+
+	if t := c.String("custom-time"); t != "" {
+		customTime, err := parseCustomTime(t, time.Now())
+
+		if err != nil {
+			return err
+		}
+
+		plugin.Config.CustomTime = customTime
+	}
+
+	if b := c.String("total-retry-budget"); b != "" {
+		retries, wait, err := parseRetryBudget(b)
+
+		if err != nil {
+			return err
+		}
+
+		plugin.Config.RetryBudget = retries
+		plugin.Config.RetryBudgetDuration = wait
+	}
+
+	if plugin.Config.Retries < 0 {
+		return errors.Errorf("Invalid retries %d, must be positive", plugin.Config.Retries)
+	}
+
+	if plugin.Config.Concurrency < 0 {
+		return errors.Errorf("Invalid concurrency %d, must be positive", plugin.Config.Concurrency)
+	}
+
+	if plugin.Config.Concurrency > maxConcurrency {
+		log.Printf("concurrency %d is too high, using %d", plugin.Config.Concurrency, maxConcurrency)
+	}
+
+	if sc := plugin.Config.StorageClass; sc != "" && !validStorageClass(sc) {
+		return errors.Errorf("Invalid storage class %q", sc)
+	}
+
+	if k := plugin.Config.KMSKey; k != "" && !validKMSKey(k) {
+		return errors.Errorf("Invalid KMS key %q, want projects/.../locations/.../keyRings/.../cryptoKeys/...", k)
+	}
+
+	if l := plugin.Config.ContentLanguage; l != "" && !validLanguageTag(l) {
+		return errors.Errorf("Invalid content language %q, want a BCP-47 tag like en-US", l)
+	}
+
+	if a := plugin.Config.PredefinedACL; a != "" && !validPredefinedACL(a) {
+		return errors.Errorf("Invalid predefined ACL %q", a)
+	}
+
+	if plugin.Config.PredefinedACL != "" && len(plugin.Config.ACL) > 0 {
+		return errors.New("Predefined ACL and ACL are mutually exclusive")
+	}
+
+	if plugin.Config.PredefinedACL != "" && len(plugin.Config.ACLMap) > 0 {
+		return errors.New("Predefined ACL and ACL map are mutually exclusive")
+	}
+
+	switch plugin.Config.DownloadExisting {
+	case "", downloadOverwrite, downloadSkip, downloadFail:
+	default:
+		return errors.Errorf("Invalid download existing policy %q", plugin.Config.DownloadExisting)
+	}
+
+	switch plugin.Config.Symlinks {
+	case "", symlinksSkip, symlinksFollow, symlinksError:
+	default:
+		return errors.Errorf("Invalid symlinks policy %q", plugin.Config.Symlinks)
+	}
+
+	if plugin.Config.MaxFileSize < 0 {
+		return errors.Errorf("Invalid max file size %d, must be positive", plugin.Config.MaxFileSize)
+	}
+
+	switch plugin.Config.MaxFileSizeAction {
+	case "", maxFileSizeSkip, maxFileSizeFail:
+	default:
+		return errors.Errorf("Invalid max file size action %q", plugin.Config.MaxFileSizeAction)
+	}
+
+	if gp := plugin.Config.GuardPolicy; gp != "" && gp != guardSkip && gp != guardFail {
+		return errors.Errorf("Invalid guard policy %q", gp)
+	}
+
+	if !validAnnotationFormat(plugin.Config.Annotations) {
+		return errors.Errorf("Invalid annotations format %q", plugin.Config.Annotations)
+	}
+
+	if a := plugin.Config.Archive; a != "" && a != archiveTarGz && a != archiveZip {
+		return errors.Errorf("Invalid archive format %q, want tar.gz or zip", a)
+	}
+
+	if plugin.Config.CreateBucket && plugin.Config.ProjectID == "" {
+		return errors.New("Create bucket requires a project ID")
+	}
+
+	if plugin.Config.Archive != "" && plugin.Config.Compose {
+		return errors.New("Archive and compose are mutually exclusive")
+	}
+
+	if len(plugin.Config.Scopes) > 0 && !hasStorageScope(plugin.Config.Scopes) {
+		return errors.Errorf("Invalid scopes %q, want at least one storage scope", plugin.Config.Scopes)
+	}
+
+	tlsConfig, err := loadTLSConfig(c.String("ca-cert"), c.Bool("insecure-skip-verify"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("insecure-skip-verify") {
+		log.Println("WARNING: TLS certificate verification is disabled, connections to GCS are NOT secure")
+	}
+
+	settings := clientSettings{
+		tlsConfig:   tlsConfig,
+		endpoint:    normalizeEndpoint(plugin.Config.Endpoint),
+		impersonate: plugin.Config.ImpersonateServiceAccount,
+		scopes:      plugin.Config.Scopes,
 	}
 
 	var client *storage.Client
-	var err error
 	if plugin.Config.workloadPoolId != "" && plugin.Config.gcpProjectId != "" && plugin.Config.providerId != "" && plugin.Config.OidcIdToken != "" && plugin.Config.serviceAccountEmail != "" {
-		client, err = gcsClientWithOIDC(plugin.Config.workloadPoolId, plugin.Config.providerId, plugin.Config.gcpProjectId, plugin.Config.serviceAccountEmail, plugin.Config.OidcIdToken)
+		client, err = gcsClientWithOIDC(settings, plugin.Config.workloadPoolId, plugin.Config.providerId, plugin.Config.gcpProjectId, plugin.Config.serviceAccountEmail, plugin.Config.OidcIdToken, plugin.Config.OidcAudience)
 		if err != nil {
 			return err
 		}
 	} else if plugin.Config.Token != "" {
-		client, err = gcsClientWithToken(plugin.Config.Token)
+		client, err = gcsClientWithToken(settings, plugin.Config.Token)
 		if err != nil {
 			return err
 		}
-	} else if c.String("json-key") != "" {
-		err := os.MkdirAll(os.TempDir(), 0600)
-		if err != nil {
-			return errors.Wrap(err, "failed to create temporary directory")
-		}
-
-		tmpfile, err := os.CreateTemp("", "")
+	} else if plugin.Config.CredentialsFile != "" {
+		client, err = gcsClientWithCredentialsFile(settings, plugin.Config.CredentialsFile)
 		if err != nil {
-			return errors.Wrap(err, "failed to create temporary file")
+			return err
 		}
-		defer os.Remove(tmpfile.Name()) // clean up
-
-		client, err = gcsClientWithJSONKey(c.String("json-key"), tmpfile)
+	} else if c.String("json-key") != "" {
+		client, err = gcsClientWithJSONKey(settings, strings.NewReader(c.String("json-key")), plugin.Config.TempDir)
 		if err != nil {
 			return err
 		}
 	} else {
-		client, err = gcsClientApplicationDefaultCredentials()
+		client, err = gcsClientApplicationDefaultCredentials(settings)
 		if err != nil {
 			return err
 		}
 	}
 
-	return plugin.Exec(client)
+	if err := plugin.Exec(client); err != nil {
+		return err
+	}
+
+	// errors logged along the way, the run went on but did not succeed
+	if plugin.exitCode() != 0 {
+		return errors.New("completed with errors")
+	}
+
+	return nil
 }
 
-func gcsClientWithToken(token string) (*storage.Client, error) {
-	auth, err := google.JWTConfigFromJSON([]byte(token), storage.ScopeFullControl)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to authenticate token")
+// metaEnvPrefix is the prefix of environment variables stored as object metadata.
+const metaEnvPrefix = "PLUGIN_META_"
+
+// envMetadata returns the metadata defined by PLUGIN_META_* variables in environ.
+// The key is the lowercased variable name without the prefix.
+func envMetadata(environ []string) map[string]string {
+	metadata := make(map[string]string)
+
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+
+		if !ok || !strings.HasPrefix(k, metaEnvPrefix) || k == metaEnvPrefix {
+			continue
+		}
+
+		metadata[strings.ToLower(strings.TrimPrefix(k, metaEnvPrefix))] = v
 	}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithTokenSource(auth.TokenSource(ctx)))
+	return metadata
+}
+
+// parseRetryBudget parses a retry budget given either as
+// a number of retries or as a total backoff duration.
+func parseRetryBudget(s string) (int, time.Duration, error) {
+	// a zero budget would read as no budget, which is unlimited
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return n, 0, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return 0, d, nil
+	}
+
+	return 0, 0, errors.Errorf("Invalid total retry budget %q, want a positive count like 10 or a duration like 2m", s)
+}
+
+// parseCustomTime parses an RFC 3339 timestamp, or now for the current time.
+func parseCustomTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now.UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialize storage")
+		return time.Time{}, errors.Errorf("Invalid custom time %q, want an RFC 3339 timestamp like 2024-01-02T15:04:05Z or now", s)
 	}
-	return client, nil
+
+	return t, nil
 }
 
-func gcsClientWithJSONKey(jsonKey string, credFile *os.File) (*storage.Client, error) {
-	if _, err := credFile.Write([]byte(jsonKey)); err != nil {
-		return nil, errors.Wrap(err, "failed to write gcs credentials to file")
+// clientSettings holds the transport settings shared by the gcsClient* constructors.
+type clientSettings struct {
+	// TLS configuration of the connections to GCS, nil for the defaults.
+	tlsConfig *tls.Config
+
+	// JSON API endpoint, empty for the GCS one.
+	endpoint string
+
+	// Service account impersonated with the credentials of the client, if any.
+	impersonate string
+
+	// OAuth scopes of the token, storage.ScopeFullControl when empty.
+	scopes []string
+}
+
+// storageScopes are the OAuth scopes granting access to GCS.
+var storageScopes = []string{
+	storage.ScopeFullControl,
+	storage.ScopeReadWrite,
+	storage.ScopeReadOnly,
+	"https://www.googleapis.com/auth/devstorage.write_only",
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/cloud-platform.read-only",
+}
+
+// hasStorageScope reports whether one of scopes grants access to GCS.
+func hasStorageScope(scopes []string) bool {
+	for _, scope := range scopes {
+		if slices.Contains(storageScopes, scope) {
+			return true
+		}
 	}
-	if err := credFile.Close(); err != nil {
-		return nil, errors.Wrap(err, "failed to close gcs credentials file")
+
+	return false
+}
+
+// scopeList returns the OAuth scopes of the token.
+func (s clientSettings) scopeList() []string {
+	if len(s.scopes) == 0 {
+		return []string{storage.ScopeFullControl}
 	}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credFile.Name()))
+	return s.scopes
+}
+
+// tokenScopes returns the OAuth scopes of the token of the credentials,
+// those needed to generate the tokens of the impersonated service
+// account when one is, those of the storage requests otherwise.
+func (s clientSettings) tokenScopes() []string {
+	if s.impersonate != "" {
+		return []string{iamcredentials.CloudPlatformScope}
+	}
+
+	return s.scopeList()
+}
+
+// newClient creates a storage client authenticated with opts.
+//
+// When a TLS configuration is set the requests go through a transport
+// using it, wrapped with the authentication described by opts.
+//
+// When a service account is impersonated, the requests are authenticated
+// with its access tokens, generated with the credentials of opts.
+//
+// With a plain HTTP endpoint, that of an emulator, requests are not
+// authenticated and opts are ignored.
+func (s clientSettings) newClient(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+	if s.impersonate != "" {
+		iamOpts := append(opts, option.WithScopes(iamcredentials.CloudPlatformScope))
+
+		if s.tlsConfig != nil {
+			trans, err := htransport.NewTransport(ctx, s.transport(), iamOpts...)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to initialize transport")
+			}
+
+			iamOpts = []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: trans})}
+		}
+
+		tokenSource, err := gcp.ImpersonateTokenSource(ctx, s.impersonate, s.scopeList(), iamOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to impersonate service account")
+		}
+
+		opts = []option.ClientOption{option.WithTokenSource(tokenSource)}
+	}
+
+	// the scopes of the credentials of opts, those of token sources are their own
+	opts = append(opts, option.WithScopes(s.scopeList()...))
+
+	if s.endpoint != "" {
+		if strings.HasPrefix(s.endpoint, "http://") {
+			opts = []option.ClientOption{option.WithoutAuthentication()}
+		}
+
+		opts = append(opts, option.WithEndpoint(s.endpoint))
+	}
+
+	if s.tlsConfig != nil {
+		trans, err := htransport.NewTransport(ctx, s.transport(), opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize transport")
+		}
+
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: trans}))
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to initialize storage")
 	}
 	return client, nil
 }
 
-func gcsClientApplicationDefaultCredentials() (*storage.Client, error) {
+// transport returns the base transport of the requests,
+// using the TLS configuration.
+func (s clientSettings) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = s.tlsConfig
+	return t
+}
+
+// context returns the context the client is created in. With a TLS
+// configuration, the requests of the token sources, like the exchange
+// of a JWT for an access token, go through it.
+func (s clientSettings) context() context.Context {
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+
+	if s.tlsConfig != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: s.transport()})
+	}
+
+	return ctx
+}
+
+// gcpOptions returns the options of the gcp helpers,
+// sending their requests through the TLS configuration.
+func (s clientSettings) gcpOptions() []option.ClientOption {
+	if s.tlsConfig == nil {
+		return nil
+	}
+
+	return []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: s.transport()})}
+}
+
+// normalizeEndpoint returns the JSON API endpoint of an endpoint given as
+// a URL, or as the host:port of an emulator like STORAGE_EMULATOR_HOST,
+// which is served over plain HTTP.
+func normalizeEndpoint(endpoint string) string {
+	if endpoint == "" {
+		return ""
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	if u, err := url.Parse(endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/storage/v1/"
+	}
+
+	return endpoint
+}
+
+// loadTLSConfig returns the TLS configuration trusting the caCert bundle,
+// given either as a path or as PEM contents, in addition to the system roots.
+// It returns nil when neither caCert nor insecure are set.
+func loadTLSConfig(caCert string, insecure bool) (*tls.Config, error) {
+	if caCert == "" && !insecure {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: insecure, //nolint: gosec
+	}
+
+	if caCert != "" {
+		pem := []byte(caCert)
+
+		if !strings.Contains(caCert, "-----BEGIN") {
+			b, err := os.ReadFile(caCert)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read CA certificate")
+			}
+			pem = b
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA certificate")
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+func gcsClientWithToken(s clientSettings, token string) (*storage.Client, error) {
+	auth, err := google.JWTConfigFromJSON([]byte(token), s.tokenScopes()...)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialize storage")
+		return nil, errors.Wrap(err, "failed to authenticate token")
 	}
-	return client, nil
+
+	ctx := s.context()
+	return s.newClient(ctx, option.WithTokenSource(auth.TokenSource(ctx)))
 }
 
-func gcsClientWithOIDC(workloadPoolId string, providerId string, gcpProjectId string, serviceAccountEmail string, OidcIdToken string) (*storage.Client, error) {
-	federalToken, err := gcp.GetFederalToken(OidcIdToken, gcpProjectId, workloadPoolId, providerId)
+// createKeyFile creates the temporary file the JSON key is written to,
+// readable by its owner only, in dir or the default temporary directory.
+func createKeyFile(dir string) (*os.File, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, errors.Wrap(err, "failed to create temporary directory")
+		}
+	}
+
+	f, err := os.CreateTemp(dir, "gcs-key-*.json")
 	if err != nil {
-		return nil, fmt.Errorf("OIDC token retrieval failed: %w", err)
+		return nil, errors.Wrap(err, "failed to create temporary file")
+	}
+
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "failed to restrict temporary file permissions")
 	}
-	oidcToken, err := gcp.GetGoogleCloudAccessToken(federalToken, serviceAccountEmail)
+
+	return f, nil
+}
+
+// removeKeyFile overwrites the key file name with zeros before removing it,
+// so that the plaintext key does not linger on disk.
+func removeKeyFile(name string) {
+	if f, err := os.OpenFile(name, os.O_WRONLY, 0); err == nil {
+		if fi, err := f.Stat(); err == nil {
+			f.Write(make([]byte, fi.Size())) //nolint: errcheck
+			f.Sync()                         //nolint: errcheck
+		}
+
+		f.Close()
+	}
+
+	os.Remove(name)
+}
+
+// gcsClientWithJSONKey creates a client authenticated with the JSON key,
+// written to a temporary file of dir for the time the client reads it.
+func gcsClientWithJSONKey(s clientSettings, jsonKey io.Reader, dir string) (*storage.Client, error) {
+	credFile, err := createKeyFile(dir)
 	if err != nil {
-		return nil, fmt.Errorf("error getting Google Cloud Access Token: %w", err)
+		return nil, err
 	}
-	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: oidcToken,
-		TokenType:   "Bearer",
-	})
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithTokenSource(tokenSource))
+	// the credentials are read once the client is created, or not at all on error
+	defer removeKeyFile(credFile.Name())
+
+	if _, err := io.Copy(credFile, jsonKey); err != nil {
+		credFile.Close()
+		return nil, errors.Wrap(err, "failed to write gcs credentials to file")
+	}
+	if err := credFile.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close gcs credentials file")
+	}
+
+	return s.newClient(s.context(), option.WithCredentialsFile(credFile.Name()))
+}
+
+func gcsClientWithCredentialsFile(s clientSettings, file string) (*storage.Client, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, errors.Wrap(err, "failed to read gcs credentials file")
+	}
+
+	return s.newClient(s.context(), option.WithCredentialsFile(file))
+}
+
+func gcsClientApplicationDefaultCredentials(s clientSettings) (*storage.Client, error) {
+	return s.newClient(s.context())
+}
+
+func gcsClientWithOIDC(s clientSettings, workloadPoolId string, providerId string, gcpProjectId string, serviceAccountEmail string, OidcIdToken string, OidcAudience string) (*storage.Client, error) {
+	tokenSource, err := gcp.NewTokenSource(OidcIdToken, gcpProjectId, workloadPoolId, providerId, OidcAudience, serviceAccountEmail, s.tokenScopes(), s.gcpOptions()...)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialize storage")
+		return nil, err
 	}
-	return client, nil
+
+	return s.newClient(s.context(), option.WithTokenSource(tokenSource))
 }
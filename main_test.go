@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+func TestEnvMetadata(t *testing.T) {
+	environ := []string{
+		"PLUGIN_META_COMMIT=abc123",
+		"PLUGIN_META_BUILD_NUMBER=42",
+		"PLUGIN_META_=ignored",
+		"PLUGIN_METADATA={}",
+		"PLUGIN_SOURCE=dist",
+		"HOME=/root",
+	}
+
+	want := map[string]string{
+		"commit":       "abc123",
+		"build_number": "42",
+	}
+	if got := envMetadata(environ); !reflect.DeepEqual(got, want) {
+		t.Errorf("envMetadata = %v; want %v", got, want)
+	}
+}
+
+func TestClientCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer srv.Close()
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	ctx := context.Background()
+	opts := []option.ClientOption{
+		option.WithoutAuthentication(),
+		option.WithEndpoint(srv.URL + "/storage/v1/"),
+	}
+
+	client, err := clientSettings{}.newClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(ctx); err == nil {
+		t.Error("expected the untrusted certificate to be rejected")
+	}
+
+	for _, caCert := range []string{ca, writeCA(t, ca)} {
+		tlsConfig, err := loadTLSConfig(caCert, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := clientSettings{tlsConfig: tlsConfig}.newClient(ctx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Bucket("bucket").Attrs(ctx); err != nil {
+			t.Errorf("Attrs with CA %q: %v", caCert, err)
+		}
+	}
+
+	if _, err := loadTLSConfig("not a certificate\n-----BEGIN", false); err == nil {
+		t.Error("expected an invalid CA certificate to fail")
+	}
+}
+
+func writeCA(t *testing.T, ca string) string {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(name, []byte(ca), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestClientEndpoint(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/storage/v1/b/bucket":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"name":"bucket"}`)
+		case "/bucket/file.txt":
+			fmt.Fprint(w, "content")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	client, err := gcsClientApplicationDefaultCredentials(clientSettings{endpoint: normalizeEndpoint(srv.URL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(ctx); err != nil {
+		t.Errorf("Attrs: %v", err)
+	}
+
+	r, err := client.Bucket("bucket").Object("file.txt").NewReader(ctx)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	defer r.Close()
+	if b, _ := io.ReadAll(r); string(b) != "content" {
+		t.Errorf("object content = %q; want content", b)
+	}
+
+	for _, a := range auth {
+		if a != "" {
+			t.Errorf("emulator request authenticated with %q", a)
+		}
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"":                                    "",
+		"localhost:4443":                      "http://localhost:4443/storage/v1/",
+		"http://localhost:4443/":              "http://localhost:4443/storage/v1/",
+		"https://gcs.example.com/storage/v1/": "https://gcs.example.com/storage/v1/",
+	}
+
+	for endpoint, want := range tests {
+		if got := normalizeEndpoint(endpoint); got != want {
+			t.Errorf("normalizeEndpoint(%q) = %q; want %q", endpoint, got, want)
+		}
+	}
+}
+
+func TestRunValidation(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--predefined-acl", "public-read"}, `Invalid predefined ACL "public-read"`},
+		{[]string{"--predefined-acl", "publicRead", "--acl", "allUsers:READER"}, "Predefined ACL and ACL are mutually exclusive"},
+		{[]string{"--chunk-size", "-1"}, "Invalid chunk size -1, must be between 0 and 1024 MB"},
+		{[]string{"--create-bucket"}, "Create bucket requires a project ID"},
+		{[]string{"--archive", "rar"}, `Invalid archive format "rar", want tar.gz or zip`},
+		{[]string{"--scopes", "https://www.googleapis.com/auth/userinfo.email"}, `Invalid scopes ["https://www.googleapis.com/auth/userinfo.email"], want at least one storage scope`},
+		{[]string{"--rename", "{dir}/{file}.${VERSION}{ext}"}, `Invalid rename template "{dir}/{file}.${VERSION}{ext}", unknown {file}`},
+	}
+
+	for _, tt := range tests {
+		args := append([]string{"gcs", "--source", "dist", "--target", "bucket"}, tt.args...)
+		err := newApp().Run(args)
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%v: err = %v; want %s", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseRetryBudget(t *testing.T) {
+	tests := []struct {
+		s       string
+		retries int
+		wait    time.Duration
+		wantErr bool
+	}{
+		{"10", 10, 0, false},
+		{"2m", 0, 2 * time.Minute, false},
+		{"-1", 0, 0, true},
+		{"0", 0, 0, true},
+		{"0s", 0, 0, true},
+		{"ten", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		retries, wait, err := parseRetryBudget(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetryBudget(%q) error = %v; wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if retries != tt.retries || wait != tt.wait {
+			t.Errorf("parseRetryBudget(%q) = %d, %s; want %d, %s", tt.s, retries, wait, tt.retries, tt.wait)
+		}
+	}
+}
+
+func TestParseCustomTime(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	tests := []struct {
+		s       string
+		want    time.Time
+		wantErr bool
+	}{
+		{"now", now, false},
+		{"2024-01-02T15:04:05Z", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), false},
+		{"2024-01-02", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCustomTime(tt.s, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCustomTime(%q) err = %v; want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseCustomTime(%q) = %v; want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestClientTokenScopes(t *testing.T) {
+	var scope string
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the assertion is a JWT signed with the key of the token
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) == 3 {
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var c struct{ Scope string }
+			json.Unmarshal(claims, &c)
+			scope = c.Scope
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer srv.Close()
+
+	token := serviceAccountKey(t, tokenSrv.URL)
+
+	tlsConfig, err := loadTLSConfig(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := clientSettings{
+		tlsConfig: tlsConfig,
+		endpoint:  srv.URL + "/storage/v1/",
+		scopes:    []string{storage.ScopeReadOnly},
+	}
+	client, err := gcsClientWithToken(s, string(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(context.Background()); err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+
+	if scope != storage.ScopeReadOnly {
+		t.Errorf("token scope = %q; want %q", scope, storage.ScopeReadOnly)
+	}
+}
+
+func TestClientTokenCACert(t *testing.T) {
+	var exchanged bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			exchanged = true
+			fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer srv.Close()
+
+	// the token endpoint is only trusted through the CA certificate
+	token := serviceAccountKey(t, srv.URL+"/token")
+
+	tlsConfig, err := loadTLSConfig(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := clientSettings{tlsConfig: tlsConfig, endpoint: srv.URL + "/storage/v1/"}
+	client, err := gcsClientWithToken(s, string(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(context.Background()); err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+
+	if !exchanged {
+		t.Error("the JWT was not exchanged for a token")
+	}
+}
+
+func TestClientTokenScopesImpersonate(t *testing.T) {
+	s := clientSettings{scopes: []string{storage.ScopeReadOnly}}
+	if got := s.tokenScopes(); !reflect.DeepEqual(got, []string{storage.ScopeReadOnly}) {
+		t.Errorf("token scopes = %q; want the storage scopes", got)
+	}
+
+	// the base credentials generate the tokens of the impersonated account
+	s.impersonate = "deploy@project.iam.gserviceaccount.com"
+	if got := s.tokenScopes(); !reflect.DeepEqual(got, []string{iamcredentials.CloudPlatformScope}) {
+		t.Errorf("token scopes = %q; want cloud-platform when impersonating", got)
+	}
+}
+
+func TestClientCredentialsFile(t *testing.T) {
+	var tokenRequests int
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	var auth string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(file, serviceAccountKey(t, tokenSrv.URL), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := loadTLSConfig(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := clientSettings{tlsConfig: tlsConfig, endpoint: srv.URL + "/storage/v1/"}
+	client, err := gcsClientWithCredentialsFile(s, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(context.Background()); err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+
+	if tokenRequests != 1 || auth != "Bearer token" {
+		t.Errorf("%d token requests, authorization %q; want 1, Bearer token", tokenRequests, auth)
+	}
+
+	if _, err := gcsClientWithCredentialsFile(s, filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing credentials file to fail")
+	}
+}
+
+// serviceAccountKey returns the JSON key of a service account
+// whose tokens are issued by tokenURI.
+func serviceAccountKey(t *testing.T, tokenURI string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "deploy@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestClientJSONKeyScopes(t *testing.T) {
+	var scope string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) == 3 {
+				claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+				var c struct{ Scope string }
+				json.Unmarshal(claims, &c)
+				scope = c.Scope
+			}
+			fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"bucket"}`)
+	}))
+	defer srv.Close()
+
+	// trusted through the default transport, without a TLS configuration
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+
+	s := clientSettings{
+		endpoint: srv.URL + "/storage/v1/",
+		scopes:   []string{storage.ScopeReadOnly},
+	}
+	client, err := gcsClientWithJSONKey(s, bytes.NewReader(serviceAccountKey(t, srv.URL+"/token")), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("bucket").Attrs(context.Background()); err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+
+	if scope != storage.ScopeReadOnly {
+		t.Errorf("token scope = %q; want %q", scope, storage.ScopeReadOnly)
+	}
+}
+
+func TestJSONKeyTempDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+
+	f, err := createKeyFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(f.Name()) != dir || fi.Mode().Perm() != 0o600 {
+		t.Errorf("key file %s with mode %v; want in %s with mode 0600", f.Name(), fi.Mode().Perm(), dir)
+	}
+	os.Remove(f.Name())
+
+	// the emulator has no bucket, the run fails once the key is used
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	args := []string{"gcs", "--source", t.TempDir(), "--target", "bucket",
+		"--json-key", string(serviceAccountKey(t, srv.URL)), "--temp-dir", dir, "--endpoint", srv.URL}
+	if err := newApp().Run(args); err == nil || !strings.Contains(err.Error(), "bucket bucket does not exist") {
+		t.Fatalf("run = %v; want the missing bucket", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left in the temporary directory; want the key file removed", len(entries))
+	}
+}
+
+func TestJSONKeyRemoved(t *testing.T) {
+	dir := t.TempDir()
+	s := clientSettings{endpoint: "http://localhost:4443/storage/v1/"}
+
+	key := serviceAccountKey(t, "http://localhost:4443/token")
+	if _, err := gcsClientWithJSONKey(s, bytes.NewReader(key), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := gcsClientWithJSONKey(s, iotest.ErrReader(errors.New("read failed")), dir)
+	if err == nil || !strings.Contains(err.Error(), "failed to write gcs credentials to file") {
+		t.Errorf("err = %v; want the key write failed", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d key files left; want none", len(entries))
+	}
+}
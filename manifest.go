@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// defaultManifestContentType is the Content-Type of the manifest object
+// when Config.ManifestContentType is not set.
+const defaultManifestContentType = "application/json"
+
+// manifest lists the objects written by a run.
+type manifest struct {
+	Bucket  string          `json:"bucket"`
+	Prefix  string          `json:"prefix"`
+	Objects []manifestEntry `json:"objects"`
+}
+
+// manifestEntry is an object of the manifest.
+type manifestEntry struct {
+	Name string `json:"name"` // object name
+	File string `json:"file"` // path relative to source
+	Size int64  `json:"size"`
+	URL  string `json:"url,omitempty"` // public URL, with Config.PublicURL
+}
+
+// uploadManifest uploads the manifest of the objects to p.Manifest,
+// relative to p.Target.
+func (p *Plugin) uploadManifest(ctx context.Context, bucket string, objects []manifestEntry) error {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	for i := range objects {
+		objects[i].File = filepath.ToSlash(objects[i].File)
+
+		if p.Config.PublicURL {
+			objects[i].URL = publicURL(bucket, objects[i].Name)
+		}
+	}
+
+	m := manifest{Bucket: bucket, Prefix: p.Config.Target, Objects: objects}
+
+	if m.Objects == nil {
+		m.Objects = []manifestEntry{}
+	}
+
+	contentType := p.Config.ManifestContentType
+
+	if contentType == "" {
+		contentType = defaultManifestContentType
+	}
+
+	return p.uploadJSON(ctx, path.Join(p.Config.Target, p.Config.Manifest), contentType, m)
+}
+
+// publicURL returns the https URL of an object, usable
+// without credentials when the object is publicly readable.
+func publicURL(bucket, object string) string {
+	u := url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + bucket + "/" + object}
+	return u.String()
+}
+
+// indexEntry is an object of the index.
+type indexEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// uploadIndex uploads the JSON listing of the names and sizes of the
+// objects, and of the existing ones kept in place of their files, to
+// p.GenerateIndex, relative to p.Target. Unlike the manifest, the index
+// is served along with the objects, so it gets their ACL and cache
+// control. It is rewritten on every run, whatever p.NoClobber and the
+// holds of the objects.
+func (p *Plugin) uploadIndex(ctx context.Context, objects []manifestEntry, existing []string) error {
+	index := make([]indexEntry, 0, len(objects)+len(existing))
+
+	for _, o := range objects {
+		index = append(index, indexEntry{Name: o.Name, Size: o.Size})
+	}
+
+	for _, name := range existing {
+		attrs, err := p.bucket.Object(name).Attrs(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "error indexing %s", name)
+		}
+
+		index = append(index, indexEntry{Name: name, Size: attrs.Size})
+	}
+
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].Name < index[j].Name
+	})
+
+	dst := path.Join(p.Config.Target, p.Config.GenerateIndex)
+
+	if p.Config.DryRun {
+		p.printf("DRY-RUN upload index of %d objects to %s", len(index), dst)
+		return nil
+	}
+
+	w := p.bucket.Object(dst).NewWriter(ctx)
+	w.ACL = p.acl
+	w.PredefinedACL = p.Config.PredefinedACL
+	w.CacheControl = p.Config.CacheControl
+
+	return p.writeJSON(w, defaultManifestContentType, index)
+}
+
+// uploadJSON uploads v encoded as JSON to the object dst.
+func (p *Plugin) uploadJSON(ctx context.Context, dst, contentType string, v interface{}) error {
+	if p.Config.DryRun {
+		p.printf("DRY-RUN upload gs://%s/%s content-type=%s", p.bucket.Object(dst).BucketName(), dst, contentType)
+		return nil
+	}
+
+	w := p.bucket.Object(dst).NewWriter(ctx)
+	w.CacheControl = "no-cache"
+
+	return p.writeJSON(w, contentType, v)
+}
+
+// writeJSON writes v encoded as JSON to w, closing it.
+func (p *Plugin) writeJSON(w *storage.Writer, contentType string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	w.ContentType = contentType
+
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return errors.Wrapf(err, "error uploading %s", w.Name)
+	}
+
+	return errors.Wrapf(w.Close(), "error uploading %s", w.Name)
+}
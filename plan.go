@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxObjectName is the maximum length in bytes of a GCS object name.
+const maxObjectName = 1024
+
+// upload is a file scheduled for upload.
+type upload struct {
+	file   string // local path
+	rel    string // path relative to p.Source
+	object string // name of the destination object
+}
+
+// planUploads computes the destination object of every file in src.
+//
+// Files mapped to the same object are resolved by resolveCollisions
+// when p.DedupeCollisions is set. Object names longer than the GCS limit
+// fail the upload before any file is sent, unless p.HashLongNames is set.
+func (p *Plugin) planUploads(src []string) ([]upload, error) {
+	uploads := make([]upload, 0, len(src))
+
+	var tooLong []string
+
+	for _, f := range src {
+		rel, err := filepath.Rel(p.Config.Source, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := p.objectName(rel)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(name) > maxObjectName {
+			if !p.Config.HashLongNames {
+				tooLong = append(tooLong, rel)
+				continue
+			}
+
+			short := shortenName(name)
+			p.printf("%s: object name longer than %d bytes, uploading as %s", rel, maxObjectName, short)
+			name = short
+		}
+
+		uploads = append(uploads, upload{file: f, rel: rel, object: name})
+	}
+
+	if len(tooLong) > 0 {
+		return nil, errors.Errorf("object names longer than %d bytes: %s", maxObjectName, strings.Join(tooLong, ", "))
+	}
+
+	if p.Config.DedupeCollisions {
+		return p.resolveCollisions(uploads)
+	}
+
+	if p.Config.Flatten {
+		if err := checkCollisions(uploads); err != nil {
+			return nil, errors.Wrap(err, "flattened object names collide")
+		}
+	}
+
+	return uploads, nil
+}
+
+// checkCollisions returns an error listing the files
+// of the uploads sharing the same object name.
+func checkCollisions(uploads []upload) error {
+	byName := make(map[string][]string)
+
+	var names []string
+
+	for _, u := range uploads {
+		if len(byName[u.object]) == 1 {
+			names = append(names, u.object)
+		}
+
+		byName[u.object] = append(byName[u.object], u.rel)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	var collisions []string
+
+	for _, name := range names {
+		collisions = append(collisions, fmt.Sprintf("%s (%s)", name, strings.Join(byName[name], ", ")))
+	}
+
+	return errors.New(strings.Join(collisions, "; "))
+}
+
+// resolveCollisions handles files mapped to the same object name.
+//
+// Files with identical content are uploaded once, the first one in walk
+// order being kept. Files with different content get a suffix made of
+// their content hash, e.g. app-1a2b3c4d.js, so none of them is overwritten.
+func (p *Plugin) resolveCollisions(uploads []upload) ([]upload, error) {
+	byName := make(map[string][]int)
+
+	for i, u := range uploads {
+		byName[u.object] = append(byName[u.object], i)
+	}
+
+	var resolved []upload
+
+	for i, u := range uploads {
+		group := byName[u.object]
+
+		if len(group) == 1 {
+			resolved = append(resolved, u)
+			continue
+		}
+
+		// resolve the whole group when reaching its first file
+		if group[0] != i {
+			continue
+		}
+
+		seen := make(map[string]string) // content hash to the file it was first seen in
+
+		for n, j := range group {
+			c := uploads[j]
+			sum, err := fileHash(c.file)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if first, ok := seen[sum]; ok {
+				p.printf("%s: identical to %s, uploaded once as %s", c.rel, first, c.object)
+				continue
+			}
+
+			seen[sum] = c.rel
+
+			if n > 0 {
+				ext := path.Ext(c.object)
+				c.object = c.object[:len(c.object)-len(ext)] + "-" + sum[:8] + ext
+				p.printf("%s: name collision, uploading as %s", c.rel, c.object)
+			}
+
+			resolved = append(resolved, c)
+		}
+	}
+
+	return resolved, nil
+}
+
+// shortenName truncates name to fit the GCS object name limit,
+// replacing its end with a hash of the full name so that distinct
+// names remain distinct. The extension is kept.
+func shortenName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	ext := path.Ext(name)
+
+	if len(ext) > 16 {
+		ext = ""
+	}
+
+	suffix := "-" + hex.EncodeToString(sum[:8]) + ext
+	n := maxObjectName - len(suffix)
+
+	// do not cut a multi-byte character in half
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+
+	return name[:n] + suffix
+}
+
+// fileHash returns the hex-encoded SHA-256 of the content of file.
+func fileHash(file string) (string, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
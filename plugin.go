@@ -1,23 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"math/rand"
 	"mime"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/andybalholm/brotli"
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -25,305 +37,2602 @@ type (
 	Config struct {
 		Token string
 
+		// Path of a credentials file, e.g. a mounted service account key,
+		// used instead of the JSON key when set.
+		CredentialsFile string
+
+		// Directory of the temporary file the JSON key is written to,
+		// the default temporary directory when empty.
+		TempDir string
+
+		// OAuth scopes of the token, storage.ScopeFullControl when empty.
+		// At least one of them must grant access to GCS.
+		Scopes []string
+
+		// Service account impersonated with the credentials of the plugin,
+		// whose access tokens authenticate the requests to GCS.
+		ImpersonateServiceAccount string
+
 		// Indicates the files ACL's to apply
 		ACL []string
 
-		// Copies the files from the specified directory.
-		Source string
+		// ACL of the files by pattern, matched against their path relative
+		// to Source. The longest matching pattern wins, * being the fallback
+		// of all files, and ACL applies to the files matching none.
+		ACLMap map[string][]string
+
+		// if true, the ACL of the uploaded files is extended with the rules
+		// of their nearest .acl sidecar, which are never uploaded.
+		ACLSidecars bool
+
+		// Predefined ACL of the uploaded objects, e.g. publicRead.
+		// It cannot be combined with ACL or ACLMap.
+		PredefinedACL string
+
+		// GCS JSON API endpoint, e.g. that of an emulator.
+		// Requests to a plain HTTP endpoint are not authenticated.
+		Endpoint string
+
+		// Copies the files from the specified directory,
+		// or stdin to the object named by Target when set to -.
+		Source string
+
+		// Destination to copy files to, including bucket name.
+		// Comma separated targets each receive every file.
+		// On download, - writes the single object of Source to stdout.
+		Target string
+
+		// Bucket and prefix of the objects, replacing the bucket and path
+		// of Target, or of Source in download mode, when Bucket is set.
+		Bucket string
+		Prefix string
+
+		// Number of files uploaded in parallel.
+		Concurrency int
+
+		// Time over which the number of files uploaded in parallel
+		// grows from one to Concurrency. All start at once when zero.
+		RampUp time.Duration
+
+		// Size in MB of the chunks of resumable uploads, so that a failure
+		// only resends the current chunk. Zero uploads every file in
+		// a single request.
+		ChunkSize int
+
+		// Number of files compressed in parallel, at most Concurrency.
+		// Unbounded when zero.
+		CompressConcurrency int
+
+		// Number of times a failed upload is retried, waiting RetryBackoff
+		// before the first retry and twice as long before each next one.
+		Retries      int
+		RetryBackoff time.Duration
+
+		// if true, the storage client does not retry failed requests itself,
+		// leaving the retries of the uploads to Retries alone.
+		DisableClientRetries bool
+
+		// if true, a source without any file to upload, or missing,
+		// is not an error, the plugin logs that there is nothing to upload
+		// and succeeds.
+		AllowEmpty bool
+
+		// Total number of retries, and of time waited before them, allowed
+		// across all the uploads. Unlimited when zero.
+		RetryBudget         int
+		RetryBudgetDuration time.Duration
+
+		// Number of upload attempts in a row allowed to fail before the
+		// bucket is deemed unavailable and the remaining uploads aborted.
+		// Unlimited when zero.
+		MaxRetriesPerBucket int
+
+		// Time allowed for the upload of each file, unlimited when zero.
+		Timeout time.Duration
+
+		// if true, plugin is set to download mode, which means `source` from the bucket will be downloaded
+		Download bool
+
+		// if true, objects under the target missing from source
+		// are deleted after the upload, mirroring source in the bucket.
+		Sync bool
+
+		// if true, the objects that would be uploaded or deleted are logged
+		// with a DRY-RUN prefix but the bucket is left untouched.
+		DryRun bool
+
+		// if true, downloads continue past failed objects and the number of
+		// written files is checked against the number of listed objects.
+		VerifyDownloadCount bool
+
+		// Policy applied to existing local files on download:
+		// overwrite, skip or fail. With DownloadCompare only files of the
+		// size of the object and not older than it are skipped or fail.
+		DownloadExisting string
+		DownloadCompare  bool
+
+		// Manifest of the SHA-256 expected for every uploaded or downloaded
+		// object, made of "name sha256" lines. Mismatching files fail.
+		ExpectedHashes string
+
+		// Number of times the download of an object reported missing is retried.
+		DownloadRetries int
+
+		// Format of the archive, tar.gz or zip, the files are uploaded as
+		// instead, to the object named by Target. Empty to upload the files.
+		Archive string
+
+		// if true, the files are uploaded as temporary parts, in walk order,
+		// composed into the single object named by Target.
+		Compose bool
+
+		// if true, the downloaded objects are written to a tar.gz file named
+		// by Target instead, their names relative to Source with DownloadBundleStrip.
+		DownloadBundle      bool
+		DownloadBundleStrip bool
+
+		// Template of the local path of downloaded objects, relative to Target.
+		// It is evaluated against a downloadPathData.
+		DownloadTemplate string
+
+		// Generation of the downloaded object, for a source naming
+		// a single object. The live version when zero.
+		Generation int64
+
+		// if set, only objects matching one of these comma separated
+		// patterns, relative to the source prefix, are downloaded.
+		DownloadFilter string
+
+		// Exclude files matching these comma separated patterns,
+		// or those of IgnoreFile, one per line. Patterns match the whole
+		// path of the files, those ending with a slash, like tmp/,
+		// every file under the directories they match.
+		Ignore     string
+		IgnoreFile string
+
+		// Directory the ignore patterns are relative to, e.g. the working
+		// directory shared by the sources of a rules file. When empty they
+		// are relative to Source.
+		IgnoreBase string
+
+		// JSON array of rules, each uploading a source with its own
+		// target, patterns, ACL, gzip and cache control.
+		RulesFile string
+
+		// if set, only files matching one of these comma separated
+		// patterns, and none of the ignore patterns, are uploaded.
+		Include string
+
+		// Leading directories stripped from the name of uploaded files,
+		// relative to source, before it is joined with the target.
+		// Files outside of it keep their name, with a warning.
+		StripPrefix string
+
+		// Leading path trimmed from the name of every uploaded file,
+		// relative to source, before it is joined with the target.
+		// It matches whole path segments: dist trims dist/a.js, not distro/a.js.
+		TrimPrefix string
+
+		// Template of the name of every uploaded file, relative to target,
+		// with the {path}, {dir}, {base}, {name} and {ext} tokens of the path
+		// relative to source and ${VAR} environment variables,
+		// e.g. {dir}/{name}.${VERSION}{ext}.
+		Rename string
+
+		// if true, files not starting with TrimPrefix keep their name
+		// instead of failing the upload.
+		TrimPrefixOptional bool
+
+		// if true, files are uploaded directly under the target,
+		// named after their base name. Colliding names fail the upload
+		// unless DedupeCollisions is set.
+		Flatten bool
+
+		// if true, downloaded files get the update time of their object
+		// as modification time.
+		PreserveMtime bool
+
+		// if true, existing objects are never overwritten, their files
+		// are skipped. The check is atomic with the upload.
+		NoClobber bool
+
+		// if true, files whose content already matches the object
+		// in the bucket are not uploaded again.
+		SkipUnchanged bool
+
+		// if true, files mapped to the same object name are uploaded once when
+		// their content is identical, or with a content hash suffix otherwise.
+		DedupeCollisions bool
+
+		// if true, object names longer than the GCS limit are truncated
+		// and suffixed with a hash of the full name instead of failing the upload.
+		HashLongNames bool
+
+		// if true, local files are removed once uploaded, and with
+		// PruneEmptyDirs the directories they leave empty.
+		DeleteSource   bool
+		PruneEmptyDirs bool
+
+		// if true, a failed upload does not stop the others and the
+		// failures are reported together once all files are processed.
+		ContinueOnError bool
+
+		// Policy applied to symbolic links under the source: skip, follow
+		// or error.
+		Symlinks string
+
+		// Size in bytes above which files are not uploaded, unlimited when zero.
+		// MaxFileSizeAction tells whether they are skipped or fail the upload.
+		MaxFileSize       int64
+		MaxFileSizeAction string
+
+		// if true, the files and directories whose name starts with a dot,
+		// like .git or .DS_Store, are not uploaded.
+		SkipHidden bool
+
+		// if true, files removed between the walk and their upload are
+		// skipped with a warning instead of failing the upload.
+		SkipVanished bool
+
+		Gzip         []string
+		Brotli       []string
+		CacheControl string
+
+		// Content types of the files gzipped in addition to those
+		// with a Gzip extension, e.g. application/json.
+		GzipContentTypes []string
+
+		// Size in bytes under which the files matching Gzip or
+		// GzipContentTypes are uploaded uncompressed. No minimum when zero.
+		GzipMinSize int64
+
+		// Metadata of the uploaded objects, where ${VAR} expands to
+		// the environment variable VAR and $$ to a literal $.
+		Metadata map[string]string
+
+		// Content-Disposition of the uploaded objects, where {filename}
+		// expands to the base name of each object.
+		ContentDisposition string
+
+		// Content-Language of the uploaded objects, as a BCP-47 tag like en-US.
+		ContentLanguage string
+
+		// Content-Type of uploaded files by extension, overriding the mime package.
+		// Extensions are matched case-insensitively, with or without a leading dot.
+		ContentTypeMap map[string]string
+
+		// Content-Type of the files of unknown type, application/octet-stream
+		// when empty.
+		DefaultContentType string
+
+		// if true, the mime package is not consulted and files not listed
+		// in ContentTypeMap get DefaultContentType.
+		DisableContentTypeDetection bool
+
+		// Content-Encoding of already encoded files by extension, e.g. br.
+		// Such files are uploaded verbatim and never gzipped.
+		EncodingMap map[string]string
+
+		// Custom time of the uploaded objects, for lifecycle rules.
+		// Unset when zero.
+		CustomTime time.Time
+
+		// if true, the uploaded objects are placed under a temporary or
+		// event-based hold, preventing their deletion until released.
+		TemporaryHold  bool
+		EventBasedHold bool
+
+		// Storage class of the uploaded objects, e.g. NEARLINE.
+		// The bucket default is used when empty.
+		StorageClass string
+
+		// Cloud KMS key used to encrypt the uploaded objects, in the form of
+		// projects/P/locations/L/keyRings/R/cryptoKeys/K.
+		KMSKey string
+
+		// if true, the gzipped content of files is decompressed and compared
+		// to the file while it is uploaded, failing the upload on mismatch.
+		VerifyGzip bool
+
+		// Patterns of the paths, relative to source, of the files and
+		// directories never gzipped. They take precedence over Gzip.
+		NoGzipGlob []string
+
+		// Extra metadata and Cache-Control applied only to gzipped objects.
+		GzipMetadata     map[string]string
+		GzipCacheControl string
+
+		// if true, the target bucket is not checked before uploading.
+		SkipBucketCheck bool
+
+		// if true, a missing target bucket is created in ProjectID,
+		// at BucketLocation or the GCS default location when empty.
+		CreateBucket   bool
+		BucketLocation string
+		ProjectID      string
+
+		// Name of an object in the target bucket guarding the upload.
+		// When it exists the upload is skipped or fails, per GuardPolicy.
+		GuardObject string
+		GuardPolicy string
+
+		// if true, the guard object is created after a successful upload.
+		GuardCreate bool
+
+		// if true, the CRC32C and MD5 of every uploaded object are logged.
+		LogHashes bool
+
+		// if true, the bytes uploaded and the throughput are logged
+		// while each file is uploaded, and in total once all are.
+		Progress bool
+
+		// if true, the time taken to upload each file is logged.
+		// Only uploads slower than SlowUploadThreshold are logged when it is set.
+		LogDurations        bool
+		SlowUploadThreshold time.Duration
+
+		// Name of the object, relative to the target, the JSON manifest of the
+		// uploaded objects is written to after a successful upload.
+		Manifest            string
+		ManifestContentType string
+
+		// Name of the object, relative to the target, the JSON index of the
+		// names and sizes of the uploaded objects is written to after a
+		// successful upload, with the same settings as the uploaded objects.
+		GenerateIndex string
+
+		// if true, the upload results are logged in upload order
+		// once all files are uploaded, instead of as they complete.
+		OrderedLog bool
+
+		// if true, the public https URL of every uploaded object is logged,
+		// and listed in the manifest. The objects must be publicly readable
+		// for it to be usable, e.g. with the publicRead PredefinedACL.
+		PublicURL bool
+
+		// if true, the upload results are listed sorted by object name
+		// once all files are uploaded, each marked ok, skipped or failed,
+		// followed by their counts.
+		SortedSummary bool
+
+		// Format of the annotations written after a successful upload:
+		// github, harness or auto. Empty disables annotations.
+		Annotations string
+
+		// URL the summary of the run is posted to, as JSON, once it is done.
+		// Unless WebhookRequired is set a failed post is only logged.
+		WebhookURL      string
+		WebhookRequired bool
+		WebhookTimeout  time.Duration
+
+		// if true, the effective configuration is logged at startup,
+		// with credentials redacted.
+		PrintConfig bool
+
+		// OIDC Config
+		workloadPoolId      string
+		providerId          string
+		gcpProjectId        string
+		serviceAccountEmail string
+		OidcIdToken         string
+		OidcAudience        string
+	}
+
+	Plugin struct {
+		Config Config
+
+		bucket *storage.BucketHandle
+
+		downloadTemplate *template.Template
+
+		// patterns of the ignored files, from p.Ignore and p.IgnoreFile.
+		ignore []string
+
+		// patterns of the included files, from p.Include.
+		include []string
+
+		// patterns of the downloaded objects, from p.DownloadFilter.
+		downloadFilter []string
+
+		// ACL rules applied to the uploaded objects, parsed from p.ACL.
+		acl []storage.ACLRule
+
+		// ACL of the files by pattern, parsed from p.ACLMap.
+		aclMap []aclMapEntry
+
+		// SHA-256 expected for the objects, read from p.ExpectedHashes.
+		expectedHashes map[string]string
+
+		// retries left for the uploads, shared by all of them.
+		retryBudget *retryBudget
+
+		// breaker aborts the uploads once p.MaxRetriesPerBucket is exceeded.
+		breaker *breaker
+
+		// summary of the upload, posted to p.WebhookURL.
+		summary summary
+
+		// compressSlots bounds the number of files compressed at once
+		// to p.CompressConcurrency, nil when unbounded.
+		compressSlots chan struct{}
+
+		// transferred is the number of bytes uploaded, counted with p.Progress.
+		transferred atomic.Int64
+
+		stdin  io.Reader
+		stdout io.Writer
+		sleep  func(time.Duration)
+		printf func(string, ...interface{})
+		fatalf func(string, ...interface{})
+
+		// first failure passed to fatalf, set when fatalf records it
+		// instead of exiting, as in the runs of execWith.
+		fatal error
+
+		ecodeMu sync.Mutex
+		ecode   int
+	}
+)
+
+const (
+	// defaultConcurrency is the upload concurrency used
+	// when Config.Concurrency is not set.
+	defaultConcurrency = 100
+
+	// maxConcurrency is the highest upload concurrency.
+	maxConcurrency = 1000
+)
+
+const (
+	// defaultChunkSize is the default size in MB of the chunks of
+	// resumable uploads, that of the storage client.
+	defaultChunkSize = 16
+
+	// maxChunkSize is the largest chunk size in MB, each chunk
+	// being buffered in memory by every upload.
+	maxChunkSize = 1024
+)
+
+// maxMetadataSize is the largest total size of the custom metadata
+// of an object accepted by GCS, keys and values included.
+const maxMetadataSize = 8 * 1024
+
+// checkMetadataSize returns an error naming the largest keys
+// when md is over maxMetadataSize.
+func checkMetadataSize(md map[string]string) error {
+	type entry struct {
+		key  string
+		size int
+	}
+
+	var (
+		entries []entry
+		total   int
+	)
+
+	for k, v := range md {
+		entries = append(entries, entry{k, len(k) + len(v)})
+		total += len(k) + len(v)
+	}
+
+	if total <= maxMetadataSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].size != entries[j].size {
+			return entries[i].size > entries[j].size
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	var keys []string
+
+	for _, e := range entries {
+		keys = append(keys, fmt.Sprintf("%s (%d bytes)", e.key, e.size))
+	}
+
+	return errors.Errorf("metadata is %d bytes, over the %d bytes limit: %s", total, maxMetadataSize, strings.Join(keys, ", "))
+}
+
+// redactedValue replaces the credentials in a printed Config.
+const redactedValue = "[redacted]"
+
+// redacted returns a copy of c with its credentials redacted.
+func (c Config) redacted() Config {
+	if c.Token != "" {
+		c.Token = redactedValue
+	}
+
+	if c.OidcIdToken != "" {
+		c.OidcIdToken = redactedValue
+	}
+
+	// webhook URLs often embed their token, like Slack ones
+	if c.WebhookURL != "" {
+		c.WebhookURL = redactedValue
+	}
+
+	return c
+}
+
+// stdinSource is the source uploading stdin as a single object.
+const stdinSource = "-"
+
+// stdoutTarget is the target downloading a single object to stdout.
+// Logs are written to stderr so they do not mix with the object.
+const stdoutTarget = "-"
+
+// errVanished is returned by uploadFile when the file no longer exists
+// and p.SkipVanished is set.
+var errVanished = errors.New("file vanished before upload")
+
+// errUnchanged is returned by uploadFile when the object already holds
+// the content of the file and p.SkipUnchanged is set.
+var errUnchanged = errors.New("object is unchanged")
+
+// errExists is returned by uploadFile when the object already exists
+// and p.NoClobber is set.
+var errExists = errors.New("object already exists, not overwritten")
+
+// Exec executes the plugin
+func (p *Plugin) Exec(client *storage.Client) error {
+	p.setDefaults()
+
+	if p.Config.Progress {
+		start := time.Now()
+		defer func() { p.logProgress(time.Since(start)) }()
+	}
+
+	exec := p.exec
+
+	targets := splitTargets(p.Config.Target)
+
+	switch {
+	case p.Config.RulesFile != "":
+		exec = p.execRules
+	case len(targets) > 1 && !p.Config.Download:
+		exec = func(client *storage.Client) error { return p.execTargets(client, targets) }
+	}
+
+	if p.Config.WebhookURL == "" {
+		return exec(client)
+	}
+
+	start := time.Now()
+	fatalf := p.fatalf
+	p.summary.Target = p.Config.Target
+
+	// fatalf exits, the webhook is called before
+	p.fatalf = func(format string, args ...interface{}) {
+		if err := p.notify(time.Since(start), fmt.Errorf(format, args...)); err != nil {
+			p.printf("webhook: %v", err)
+		}
+
+		fatalf(format, args...)
+	}
+
+	err := exec(client)
+
+	if werr := p.notify(time.Since(start), err); werr != nil {
+		if err == nil && p.Config.WebhookRequired {
+			return errors.Wrap(werr, "webhook")
+		}
+
+		p.printf("webhook: %v", werr)
+	}
+
+	return err
+}
+
+// setDefaults sets the output and clock functions left unset.
+func (p *Plugin) setDefaults() {
+	if p.printf == nil {
+		p.printf = log.Printf
+	}
+
+	if p.fatalf == nil {
+		p.fatalf = log.Fatalf
+	}
+
+	if p.stdin == nil {
+		p.stdin = os.Stdin
+	}
+
+	if p.stdout == nil {
+		p.stdout = os.Stdout
+	}
+
+	if p.sleep == nil {
+		p.sleep = time.Sleep
+	}
+}
+
+// exec uploads or downloads the files.
+func (p *Plugin) exec(client *storage.Client) error {
+	registerMimeTypes.Do(addMimeTypes)
+
+	if p.Config.DisableClientRetries {
+		client.SetRetry(storage.WithPolicy(storage.RetryNever))
+	}
+
+	ignore, err := loadIgnorePatterns(p.Config.Ignore, p.Config.IgnoreFile)
+
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range ignore {
+		if err := validatePattern(strings.TrimSuffix(pattern, "/")); err != nil {
+			return errors.Wrap(err, "invalid ignore pattern")
+		}
+	}
+
+	p.ignore = ignore
+	p.include = splitPatterns(p.Config.Include)
+
+	for _, pattern := range p.include {
+		if err := validatePattern(strings.TrimSuffix(pattern, "/")); err != nil {
+			return errors.Wrap(err, "invalid include pattern")
+		}
+	}
+
+	for _, pattern := range p.Config.NoGzipGlob {
+		if err := validatePattern(pattern); err != nil {
+			return errors.Wrap(err, "invalid no-gzip pattern")
+		}
+	}
+
+	p.Config.Rename = p.expandEnv("rename", p.Config.Rename)
+	p.Config.Metadata = p.expandMetadata(p.Config.Metadata)
+	p.Config.GzipMetadata = p.expandMetadata(p.Config.GzipMetadata)
+
+	if err := checkMetadataSize(p.Config.Metadata); err != nil {
+		return err
+	}
+
+	if len(p.Config.GzipMetadata) > 0 {
+		if err := checkMetadataSize(mergeMetadata(p.Config.Metadata, p.Config.GzipMetadata)); err != nil {
+			return errors.Wrap(err, "gzip metadata")
+		}
+	}
+
+	acl, err := parseACLs(p.Config.ACL)
+
+	if err != nil {
+		return err
+	}
+
+	p.acl = acl
+
+	aclMap, err := parseACLMap(p.Config.ACLMap)
+
+	if err != nil {
+		return err
+	}
+
+	p.aclMap = aclMap
+
+	if n := p.Config.CompressConcurrency; n > 0 {
+		p.compressSlots = make(chan struct{}, n)
+	}
+
+	p.retryBudget = p.newRetryBudget()
+	p.breaker = p.newBreaker()
+	defer p.breaker.stop()
+
+	if p.Config.ExpectedHashes != "" {
+		hashes, err := readExpectedHashes(p.Config.ExpectedHashes)
+
+		if err != nil {
+			return err
+		}
+
+		p.expectedHashes = hashes
+	}
+
+	sort.Strings(p.Config.Gzip)
+	sort.Strings(p.Config.Brotli)
+	p.Config.ContentTypeMap = normalizeExtMap(p.Config.ContentTypeMap)
+	p.Config.EncodingMap = normalizeExtMap(p.Config.EncodingMap)
+	rand.Seed(time.Now().UnixNano()) //nolint: staticcheck
+
+	for _, ext := range p.Config.Brotli {
+		if p.matchCompress(p.Config.Gzip, "file."+ext) {
+			p.printf("warning: %s is listed for both gzip and brotli, using brotli", ext)
+		}
+	}
+
+	if p.Config.PrintConfig {
+		p.printf("effective config: %+v", p.Config.redacted())
+	}
+
+	// If in download mode, call the Download method.
+	// The target is a local directory in that case.
+	if p.Config.Download {
+		bname, remainingPath := extractBucketName(p.Config.Source)
+
+		if p.Config.Bucket != "" {
+			bname, remainingPath = p.Config.Bucket, strings.TrimLeft(p.Config.Prefix, "/")
+		}
+
+		p.Config.Source = remainingPath
+
+		p.bucket = client.Bucket(strings.Trim(bname, "/"))
+
+		p.downloadFilter = splitPatterns(p.Config.DownloadFilter)
+
+		for _, pattern := range p.downloadFilter {
+			if err := validatePattern(strings.TrimSuffix(pattern, "/")); err != nil {
+				return errors.Wrap(err, "invalid download filter pattern")
+			}
+		}
+
+		if p.Config.DownloadTemplate != "" {
+			tmpl, err := parseDownloadTemplate(p.Config.DownloadTemplate)
+
+			if err != nil {
+				return err
+			}
+
+			p.downloadTemplate = tmpl
+		}
+
+		log.Println("Downloading objects from bucket: ", bname, " using path: ", remainingPath)
+
+		ctx := context.Background()
+		query := &storage.Query{Prefix: p.Config.Source}
+
+		return p.downloadObjects(ctx, query)
+	}
+
+	// extract bucket name from the target path
+	bname, prefix := parseTarget(p.Config.Target)
+
+	if p.Config.Bucket != "" {
+		bname, prefix = p.Config.Bucket, strings.Trim(p.Config.Prefix, "/")
+	}
+
+	p.Config.Target = prefix
+
+	p.bucket = client.Bucket(bname)
+
+	if !p.Config.SkipBucketCheck {
+		if err := p.checkBucket(context.Background(), bname); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.GuardObject != "" {
+		exists, err := p.guardExists(context.Background())
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			if p.Config.GuardPolicy == guardFail {
+				return fmt.Errorf("guard object %s exists", p.Config.GuardObject)
+			}
+
+			p.printf("guard object %s exists, skipping upload", p.Config.GuardObject)
+			return nil
+		}
+	}
+
+	// a source of - uploads stdin to the object named by the target
+	if p.Config.Source == stdinSource {
+		if p.Config.Target == "" {
+			return errors.New("target must name the object uploaded from stdin")
+		}
+
+		if err := p.uploadStream(context.Background(), p.Config.Target, p.stdin); err != nil {
+			return errors.Wrap(err, "error uploading stdin")
+		}
+
+		p.printf("%s", p.Config.Target)
+		p.summary.Uploaded++
+		return nil
+	}
+
+	// create a list of files to upload
+	if !strings.HasPrefix(p.Config.Source, "/") {
+		pwd, err := os.Getwd()
+
+		if err != nil {
+			return errors.Wrap(err, "failed to get working dir")
+		}
+
+		p.printf("source path relative to %s", pwd)
+		p.Config.Source = filepath.Join(pwd, p.Config.Source)
+	}
+
+	if base := p.Config.IgnoreBase; base != "" && !filepath.IsAbs(base) {
+		abs, err := filepath.Abs(base)
+
+		if err != nil {
+			return errors.Wrap(err, "failed to get ignore base")
+		}
+
+		p.Config.IgnoreBase = abs
+	}
+
+	src, err := p.walkFiles()
+
+	// a missing source has no files either
+	if _, serr := os.Stat(p.Config.Source); p.Config.AllowEmpty && os.IsNotExist(serr) {
+		src, err = nil, nil
+	}
+
+	if err != nil {
+		p.fatalf("local files: %v", err)
+
+		if p.fatal != nil {
+			return p.fatal
+		}
+	} else if len(src) == 0 {
+		switch {
+		case p.Config.AllowEmpty:
+			p.printf("nothing to upload, no files in %s", p.Config.Source)
+			return nil
+		case p.Config.Sync:
+			return errors.New("refusing to sync an empty source, it would delete every object under the target")
+		default:
+			return errors.Errorf("no files to upload in %s, set allow-empty to succeed anyway", p.Config.Source)
+		}
+	}
+
+	// with p.Archive the files are uploaded as a single archive named by the target
+	if p.Config.Archive != "" {
+		return p.execArchive(src)
+	}
+
+	// with p.Compose the files are the parts of a single object named by the target
+	if p.Config.Compose {
+		return p.execCompose(src)
+	}
+
+	uploads, err := p.planUploads(src)
+
+	if err != nil {
+		return err
+	}
+
+	// result contains upload result of a single file
+	type result struct {
+		index    int
+		name     string
+		object   string
+		err      error
+		size     int64
+		duration time.Duration
+	}
+
+	// upload all files in a goroutine, p.Concurrency at a time
+	buf := make(chan struct{}, p.concurrency())
+	res := make(chan *result, len(uploads))
+
+	done := make(chan struct{})
+	defer close(done)
+
+	p.rampUp(buf, done)
+
+	for i, u := range uploads {
+		buf <- struct{}{} // alloc one slot
+
+		go func(i int, u upload) {
+			defer func() { <-buf }() // free up
+
+			start := time.Now()
+			err := p.retryUpload(u.object, u.file)
+			r := &result{index: i, name: u.rel, object: u.object, err: err, duration: time.Since(start)}
+
+			if fi, err := os.Stat(u.file); err == nil {
+				r.size = fi.Size()
+			}
+
+			res <- r
+		}(i, u)
+	}
+
+	// with p.OrderedLog the results are logged in upload order once all are done,
+	// with p.SortedSummary in object order, each with a status line first
+	ordered := make([][]string, len(uploads))
+	logf := func(i int, format string, args ...interface{}) {
+		if p.Config.OrderedLog || p.Config.SortedSummary {
+			ordered[i] = append(ordered[i], fmt.Sprintf(format, args...))
+			return
+		}
+
+		p.printf(format, args...)
+	}
+
+	// the line of the result, replaced by its status line with p.SortedSummary
+	resultf := func(i int, format string, args ...interface{}) {
+		if !p.Config.SortedSummary {
+			logf(i, format, args...)
+		}
+	}
+
+	statusf := func(i int, status, format string, args ...interface{}) {
+		if p.Config.SortedSummary {
+			ordered[i] = append(ordered[i], fmt.Sprintf("%-7s ", status)+fmt.Sprintf(format, args...))
+		}
+	}
+
+	// wait for all files to be uploaded or stop at first error,
+	// unless p.ContinueOnError is set
+	var uploaded int
+	objects := make(map[string]bool, len(uploads))
+
+	var entries []manifestEntry
+
+	// objects kept in place of their files with p.NoClobber
+	var existing []string
+
+	// files which failed to upload with p.ContinueOnError
+	var failed []string
+
+	// files removed once uploaded with p.DeleteSource
+	var deleted []string
+
+	for range uploads {
+		r := <-res
+
+		if errors.Is(r.err, errVanished) {
+			resultf(r.index, "%s: skipped, %v", r.name, r.err)
+			statusf(r.index, "skipped", "%s: %v", r.object, r.err)
+			p.summary.Skipped++
+			continue
+		}
+
+		// the existing object is kept, sync must not delete it
+		if errors.Is(r.err, errExists) {
+			resultf(r.index, "%s: skipped, %v", r.name, r.err)
+			statusf(r.index, "skipped", "%s: %v", r.object, r.err)
+			p.summary.Skipped++
+			objects[r.object] = true
+			existing = append(existing, r.object)
+			continue
+		}
+
+		if errors.Is(r.err, errUnchanged) {
+			resultf(r.index, "%s: skipped, %v", r.name, r.err)
+			statusf(r.index, "skipped", "%s: %v", r.object, r.err)
+			p.summary.Skipped++
+			objects[r.object] = true
+			entries = append(entries, manifestEntry{Name: r.object, File: r.name, Size: r.size})
+			continue
+		}
+
+		// reported once all are done
+		if errors.Is(r.err, errBucketUnavailable) {
+			statusf(r.index, "failed", "%s: %v", r.object, r.err)
+			p.summary.Failed++
+			continue
+		}
+
+		if r.err != nil {
+			statusf(r.index, "failed", "%s: %v", r.object, r.err)
+			p.summary.Failed++
+
+			if !p.Config.ContinueOnError {
+				p.fatalf("%s: %v", r.name, r.err)
+				continue
+			}
+
+			p.errorf("%s: %v", r.name, r.err)
+			failed = append(failed, r.name)
+			continue
+		}
+
+		resultf(r.index, "%s", r.name)
+		statusf(r.index, "ok", "%s", r.object)
+
+		if p.Config.PublicURL {
+			logf(r.index, "%s: %s", r.name, publicURL(bname, r.object))
+		}
+
+		if p.Config.DeleteSource && !p.Config.DryRun {
+			file := uploads[r.index].file
+
+			if err := os.Remove(file); err != nil {
+				p.printf("warning: %v", err)
+			} else {
+				deleted = append(deleted, file)
+			}
+		}
+
+		uploaded++
+		p.summary.Uploaded++
+		p.summary.Bytes += r.size
+		objects[r.object] = true
+		entries = append(entries, manifestEntry{Name: r.object, File: r.name, Size: r.size})
+
+		if p.Config.LogDurations && r.duration >= p.Config.SlowUploadThreshold {
+			logf(r.index, "%s: uploaded in %s", r.name, r.duration)
+		}
+	}
+
+	p.logBuffered(uploads, ordered)
+
+	if p.Config.PruneEmptyDirs {
+		p.pruneEmptyDirs(deleted)
+	}
+
+	if p.fatal != nil {
+		return p.fatal
+	}
+
+	if p.breaker.tripped() {
+		return errors.Errorf("bucket %s appears unavailable, aborted after more than %d failures in a row", bname, p.Config.MaxRetriesPerBucket)
+	}
+
+	// the bucket is left as is, sync would delete the objects of the failed files
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("%d of %d files failed to upload: %s", len(failed), len(uploads), strings.Join(failed, ", "))
+	}
+
+	if p.Config.Sync {
+		if err := p.deleteStale(context.Background(), objects); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.Manifest != "" {
+		if err := p.uploadManifest(context.Background(), bname, entries); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.GenerateIndex != "" {
+		if err := p.uploadIndex(context.Background(), entries, existing); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.GuardObject != "" && p.Config.GuardCreate {
+		if err := p.createGuard(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.Annotations != "" {
+		if err := p.annotate(bname, uploaded); err != nil {
+			p.printf("annotations: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// pruneEmptyDirs removes the directories of files, and their parents
+// up to p.Source excluded, left empty.
+func (p *Plugin) pruneEmptyDirs(files []string) {
+	dirs := make(map[string]bool)
+
+	for _, f := range files {
+		for dir := filepath.Dir(f); ; dir = filepath.Dir(dir) {
+			rel, err := filepath.Rel(p.Config.Source, dir)
+
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") || dirs[dir] {
+				break
+			}
+
+			dirs[dir] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(dirs))
+
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+
+	// children sort after their parent, remove them first
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	for _, dir := range sorted {
+		// directories still holding files fail to be removed
+		os.Remove(dir)
+	}
+}
+
+// concurrency returns the number of parallel uploads,
+// clamped to the [1, maxConcurrency] range.
+func (p *Plugin) concurrency() int {
+	switch n := p.Config.Concurrency; {
+	case n <= 0:
+		return defaultConcurrency
+	case n > maxConcurrency:
+		return maxConcurrency
+	default:
+		return n
+	}
+}
+
+// rampUp reserves all the slots of buf but one, then frees them evenly
+// over p.RampUp so that uploads start gradually, until done is closed.
+func (p *Plugin) rampUp(buf chan struct{}, done <-chan struct{}) {
+	n := cap(buf)
+
+	if p.Config.RampUp <= 0 || n < 2 {
+		return
+	}
+
+	for i := 1; i < n; i++ {
+		buf <- struct{}{}
+	}
+
+	step := p.Config.RampUp / time.Duration(n-1)
+
+	go func() {
+		for i := 1; i < n; i++ {
+			p.sleep(step)
+
+			select {
+			case <-buf:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// validStorageClass reports whether class is a storage class known to GCS.
+func validStorageClass(class string) bool {
+	switch class {
+	case "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", "MULTI_REGIONAL", "REGIONAL":
+		return true
+	}
+
+	return false
+}
+
+// Policies applied when the guard object exists.
+const (
+	guardSkip = "skip"
+	guardFail = "fail"
+)
+
+// logBuffered logs the lines buffered for every upload, in upload order.
+// With p.SortedSummary they are sorted by object name instead, and
+// followed by the counts of uploaded, skipped and failed files.
+func (p *Plugin) logBuffered(uploads []upload, lines [][]string) {
+	order := make([]int, len(uploads))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	if p.Config.SortedSummary {
+		sort.SliceStable(order, func(a, b int) bool {
+			return uploads[order[a]].object < uploads[order[b]].object
+		})
+	}
+
+	for _, i := range order {
+		for _, line := range lines[i] {
+			p.printf("%s", line)
+		}
+	}
+
+	if p.Config.SortedSummary {
+		p.printf("%d uploaded, %d skipped, %d failed", p.summary.Uploaded, p.summary.Skipped, p.summary.Failed)
+	}
+}
+
+// checkBucket verifies that the target bucket exists and is accessible,
+// so that a misconfigured bucket fails before any file is uploaded.
+func (p *Plugin) checkBucket(ctx context.Context, name string) error {
+	_, err := p.bucket.Attrs(ctx)
+
+	if err == storage.ErrBucketNotExist && p.Config.CreateBucket {
+		return p.createBucket(ctx, name)
+	}
+
+	if err == storage.ErrBucketNotExist {
+		return errors.Errorf("bucket %s does not exist, check the bucket name of the target for typos", name)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "cannot access bucket %s, check its name and that the credentials are allowed to use it", name)
+	}
+
+	return nil
+}
+
+// createBucket creates the missing target bucket name in p.ProjectID.
+func (p *Plugin) createBucket(ctx context.Context, name string) error {
+	if p.Config.ProjectID == "" {
+		return errors.Errorf("bucket %s does not exist and cannot be created without a project ID", name)
+	}
+
+	if p.Config.DryRun {
+		p.printf("DRY-RUN create bucket %s in project %s", name, p.Config.ProjectID)
+		return nil
+	}
+
+	attrs := &storage.BucketAttrs{Location: p.Config.BucketLocation}
+
+	if err := p.bucket.Create(ctx, p.Config.ProjectID, attrs); err != nil {
+		return errors.Wrapf(err, "error creating bucket %s", name)
+	}
+
+	p.printf("created bucket %s in project %s", name, p.Config.ProjectID)
+	return nil
+}
+
+// guardExists reports whether p.GuardObject exists in the target bucket.
+func (p *Plugin) guardExists(ctx context.Context) (bool, error) {
+	_, err := p.bucket.Object(p.Config.GuardObject).Attrs(ctx)
+
+	switch {
+	case err == storage.ErrObjectNotExist:
+		return false, nil
+	case err != nil:
+		return false, errors.Wrapf(err, "error checking guard object %s", p.Config.GuardObject)
+	}
+
+	return true, nil
+}
+
+// createGuard creates an empty p.GuardObject in the target bucket.
+func (p *Plugin) createGuard(ctx context.Context) error {
+	if p.Config.DryRun {
+		p.printf("DRY-RUN create guard object %s", p.Config.GuardObject)
+		return nil
+	}
+
+	w := p.bucket.Object(p.Config.GuardObject).NewWriter(ctx)
+
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "error creating guard object %s", p.Config.GuardObject)
+	}
+
+	p.printf("created guard object %s", p.Config.GuardObject)
+	return nil
+}
+
+// validPredefinedACL reports whether acl is a predefined object ACL known to GCS.
+func validPredefinedACL(acl string) bool {
+	switch acl {
+	case "authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead":
+		return true
+	}
+	return false
+}
+
+// kmsKeyPattern matches the resource name of a Cloud KMS key.
+var kmsKeyPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// validKMSKey reports whether key looks like a Cloud KMS key resource name.
+func validKMSKey(key string) bool {
+	return kmsKeyPattern.MatchString(key)
+}
+
+// languageTagPattern matches the shape of a BCP-47 language tag.
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// validLanguageTag reports whether tag looks like a BCP-47 language tag.
+func validLanguageTag(tag string) bool {
+	return languageTagPattern.MatchString(tag)
+}
+
+// errorf sets exit code to a non-zero value and outputs using printf.
+func (p *Plugin) errorf(format string, args ...interface{}) {
+	p.ecodeMu.Lock()
+	p.ecode = 1
+	p.ecodeMu.Unlock()
+	p.printf(format, args...)
+}
+
+// exitCode returns the exit code set by errorf, zero if none.
+func (p *Plugin) exitCode() int {
+	p.ecodeMu.Lock()
+	defer p.ecodeMu.Unlock()
+
+	return p.ecode
+}
+
+// deleteStale deletes the objects under p.Target which are not in keep,
+// so that the bucket mirrors the source.
+//
+// Objects matching p.Ignore, relative to p.Target, are left untouched
+// as their local counterparts were not considered.
+//
+// Objects whose name only differs from a kept one by case or Unicode
+// normalization are kept too, with a warning: a listing of such names
+// may not be byte for byte identical to the uploaded ones, and deleting
+// a just-uploaded object is worse than leaving a stale one.
+func (p *Plugin) deleteStale(ctx context.Context, keep map[string]bool) error {
+	canonical := make(map[string]string, len(keep))
+
+	for name := range keep {
+		canonical[canonicalName(name)] = name
+	}
+
+	prefix := p.Config.Target
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	it := p.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	for {
+		attrs, err := it.Next()
+
+		if err == iterator.Done {
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error while iterating through GCS objects")
+		}
+
+		if keep[attrs.Name] {
+			continue
+		}
+
+		if name, ok := canonical[canonicalName(attrs.Name)]; ok {
+			p.printf("%s: not deleted, its name matches %s", attrs.Name, name)
+			continue
+		}
+
+		if rel := strings.TrimPrefix(attrs.Name, prefix); p.shouldIgnoreFile(rel) || !p.shouldIncludeFile(rel) {
+			continue
+		}
+
+		if p.Config.DryRun {
+			p.printf("DRY-RUN delete gs://%s/%s", attrs.Bucket, attrs.Name)
+			continue
+		}
+
+		if err := p.bucket.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return errors.Wrapf(err, "error deleting %s", attrs.Name)
+		}
+
+		p.printf("deleted %s", attrs.Name)
+	}
+}
+
+// canonicalName returns name in Unicode NFC form and lowercase,
+// so that names differing only by encoding or case compare equal.
+func canonicalName(name string) string {
+	return strings.ToLower(norm.NFC.String(name))
+}
+
+// objectName returns the name of the object a file is uploaded to,
+// given its path relative to p.Source.
+//
+// The p.StripPrefix directories, then the p.TrimPrefix, are removed from rel,
+// which is then renamed by p.Rename before it is joined with p.Target.
+func (p *Plugin) objectName(rel string) (string, error) {
+	rel = filepath.ToSlash(rel)
+
+	if p.Config.StripPrefix != "" {
+		prefix := strings.Trim(filepath.ToSlash(p.Config.StripPrefix), "/") + "/"
+
+		if strings.HasPrefix(rel, prefix) {
+			rel = strings.TrimPrefix(rel, prefix)
+		} else {
+			p.printf("warning: %s is not under strip prefix %s, keeping its name", rel, p.Config.StripPrefix)
+		}
+	}
+
+	if prefix := strings.Trim(filepath.ToSlash(p.Config.TrimPrefix), "/"); prefix != "" {
+		switch {
+		case rel == prefix:
+			rel = ""
+		case strings.HasPrefix(rel, prefix+"/"):
+			rel = strings.TrimPrefix(rel, prefix+"/")
+		case !p.Config.TrimPrefixOptional:
+			return "", fmt.Errorf("%s: does not start with trim prefix %q", rel, p.Config.TrimPrefix)
+		}
+	}
+
+	if p.Config.Flatten {
+		rel = path.Base(rel)
+	}
+
+	if p.Config.Rename != "" {
+		name, err := p.rename(rel)
+
+		if err != nil {
+			return "", err
+		}
+
+		rel = name
+	}
+
+	return path.Join(p.Config.Target, rel), nil
+}
+
+// uploadStream uploads the content read from r to the object dst.
+//
+// The content is compressed when dst matches p.Gzip or p.Brotli, and typed
+// after the extension of dst in p.ContentTypeMap, p.DefaultContentType otherwise.
+func (p *Plugin) uploadStream(ctx context.Context, dst string, r io.Reader) error {
+	enc := p.compression(dst)
+	contentType := p.defaultContentType()
+
+	if t, ok := p.Config.ContentTypeMap[normalizeExt(path.Ext(dst))]; ok {
+		contentType = t
+	}
+
+	if p.Config.DryRun {
+		if enc == "" {
+			enc = "none"
+		}
+
+		p.printf("DRY-RUN upload gs://%s/%s content-type=%s compression=%s",
+			p.bucket.Object(dst).BucketName(), dst, contentType, enc)
+		return nil
+	}
+
+	rc := p.compress(io.NopCloser(r), enc, "")
+	defer rc.Close()
+
+	// cancelled rather than closing the writer on error,
+	// which would upload the partial content
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := p.newWriter(ctx, dst, enc)
+	w.ContentType = contentType
+
+	if _, err := io.Copy(w, rc); err != nil {
+		cancel()
+		return err
+	}
+
+	return w.Close()
+}
+
+// newWriter returns a writer to the object dst, with the attributes
+// of all the uploaded objects and those of content compressed with enc.
+func (p *Plugin) newWriter(ctx context.Context, dst, enc string) *storage.Writer {
+	o := p.bucket.Object(dst)
+
+	if p.Config.NoClobber {
+		o = o.If(storage.Conditions{DoesNotExist: true})
+	}
+
+	w := o.NewWriter(ctx)
+	p.setObjectAttrs(&w.ObjectAttrs, dst)
+	w.ChunkSize = p.Config.ChunkSize * 1024 * 1024
+
+	switch enc {
+	case encodingBrotli:
+		w.ContentEncoding = encodingBrotli
+	case encodingGzip:
+		w.ContentEncoding = encodingGzip
+
+		if p.Config.GzipCacheControl != "" {
+			w.CacheControl = p.Config.GzipCacheControl
+		}
+
+		if len(p.Config.GzipMetadata) > 0 {
+			w.Metadata = mergeMetadata(p.Config.Metadata, p.Config.GzipMetadata)
+		}
+	}
+
+	return w
+}
+
+// setObjectAttrs sets the attributes of all the uploaded objects
+// on attrs, those of the object dst.
+func (p *Plugin) setObjectAttrs(attrs *storage.ObjectAttrs, dst string) {
+	attrs.CacheControl = p.Config.CacheControl
+	attrs.ContentDisposition = strings.ReplaceAll(p.Config.ContentDisposition, "{filename}", path.Base(dst))
+	attrs.ContentLanguage = p.Config.ContentLanguage
+	attrs.Metadata = p.Config.Metadata
+	attrs.StorageClass = p.Config.StorageClass
+	attrs.KMSKeyName = p.Config.KMSKey
+	attrs.ACL = p.acl
+	attrs.PredefinedACL = p.Config.PredefinedACL
+	attrs.CustomTime = p.Config.CustomTime
+	attrs.TemporaryHold = p.Config.TemporaryHold
+	attrs.EventBasedHold = p.Config.EventBasedHold
+}
+
+// retryUpload uploads the file to dst using uploadFile,
+// retrying up to p.Retries times with an exponential backoff.
+// Errors that would fail again, like a missing bucket, are not retried.
+func (p *Plugin) retryUpload(dst, file string) error {
+	return p.retry(dst, func() error {
+		return p.uploadFile(dst, file)
+	})
+}
+
+// retry calls upload, uploading the object dst, as retryUpload does.
+func (p *Plugin) retry(dst string, upload func() error) error {
+	backoff := p.Config.RetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		if p.breaker.tripped() {
+			return errBucketUnavailable
+		}
+
+		err := upload()
+
+		if p.breaker.record(err) {
+			if err != nil && !errors.Is(err, context.Canceled) {
+				p.printf("%s: %v, more than %d failures in a row, aborting", dst, err, p.Config.MaxRetriesPerBucket)
+			}
+
+			return errBucketUnavailable
+		}
+
+		if err == nil || attempt > p.Config.Retries || !retryable(err) {
+			return err
+		}
+
+		// a rate-limited upload waits as long as GCS asks
+		wait := backoff
+
+		if d, ok := retryAfter(err); ok {
+			wait = d
+		}
+
+		if !p.retryBudget.take(wait) {
+			p.printf("%s: attempt %d failed: %v, retry budget exhausted", dst, attempt, err)
+			return err
+		}
+
+		p.printf("%s: attempt %d of %d failed: %v, retrying in %s", dst, attempt, p.Config.Retries+1, err, wait)
+		p.sleep(wait)
+		backoff *= 2
+	}
+}
+
+// logHashes logs the CRC32C and MD5 of the uploaded object dst, as
+// computed by GCS. Those of objects compressed with enc are of the
+// compressed bytes.
+func (p *Plugin) logHashes(dst, enc string, attrs *storage.ObjectAttrs) {
+	if attrs == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s: crc32c=%08x md5=%x", dst, attrs.CRC32C, attrs.MD5)
+
+	if enc != "" {
+		line += fmt.Sprintf(" (of the %s compressed content)", enc)
+	}
+
+	p.printf("%s", line)
+}
+
+// retryAfter returns the wait asked by the Retry-After header
+// of a 429 Too Many Requests error, given in seconds or as a date.
+func retryAfter(err error) (time.Duration, bool) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	v := gerr.Header.Get("Retry-After")
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// retryBudget bounds the retries of all the uploads of a run,
+// by their number and by the total time waited before them.
+// A nil budget is unlimited.
+type retryBudget struct {
+	mu      sync.Mutex
+	retries int           // retries left, unlimited when negative
+	wait    time.Duration // backoff left, unlimited when negative
+}
+
+// newRetryBudget returns the budget of p.RetryBudget retries and
+// p.RetryBudgetDuration of backoff, nil when neither is set.
+func (p *Plugin) newRetryBudget() *retryBudget {
+	if p.Config.RetryBudget <= 0 && p.Config.RetryBudgetDuration <= 0 {
+		return nil
+	}
+
+	b := &retryBudget{retries: -1, wait: -1}
+
+	if p.Config.RetryBudget > 0 {
+		b.retries = p.Config.RetryBudget
+	}
+
+	if p.Config.RetryBudgetDuration > 0 {
+		b.wait = p.Config.RetryBudgetDuration
+	}
+
+	return b
+}
+
+// take reserves a retry preceded by backoff, reporting whether the budget allowed it.
+func (b *retryBudget) take(backoff time.Duration) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.retries == 0 || (b.wait >= 0 && b.wait < backoff) {
+		return false
+	}
+
+	if b.retries > 0 {
+		b.retries--
+	}
+
+	if b.wait >= 0 {
+		b.wait -= backoff
+	}
+
+	return true
+}
+
+// retryable reports whether an upload failing with err may succeed when retried.
+func retryable(err error) bool {
+	if errors.Is(err, errVanished) || errors.Is(err, errUnchanged) || errors.Is(err, errExists) || errors.Is(err, errUnexpectedHash) ||
+		errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return false
+	}
+
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return false
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
+// uploadFile uploads the file to dst using global bucket.
+// To get a more robust upload use retryUpload instead.
+func (p *Plugin) uploadFile(dst, file string) error {
+	if p.Config.DryRun {
+		enc := p.compression(file)
+
+		if fi, err := os.Stat(file); err == nil {
+			enc = p.fileCompression(file, fi.Size())
+		}
+
+		if enc == "" {
+			enc = "none"
+		}
+
+		p.printf("DRY-RUN upload gs://%s/%s content-type=%s compression=%s",
+			p.bucket.Object(dst).BucketName(), dst, p.contentType(file), enc)
+		return nil
+	}
+
+	ctx := p.breaker.context()
+
+	if p.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Config.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := p.writeObject(ctx, dst, file)
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Errorf("upload of %s timed out after %s", file, time.Since(start).Round(time.Millisecond))
+	}
+
+	return err
+}
+
+// writeObject writes the content of file to the object dst.
+func (p *Plugin) writeObject(ctx context.Context, dst, file string) error {
+	if p.expectedHashes != nil {
+		if err := p.checkHash(dst, file); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.SkipUnchanged {
+		unchanged, err := p.unchanged(ctx, dst, file)
+
+		if os.IsNotExist(err) && p.Config.SkipVanished {
+			return errVanished
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if unchanged {
+			return errUnchanged
+		}
+	}
+
+	r, enc, err := p.compressor(file)
+
+	if os.IsNotExist(err) && p.Config.SkipVanished {
+		return errVanished
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	// cancelled rather than closing the writer on error,
+	// which would upload the partial content
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := p.newWriter(ctx, dst, enc)
+	w.ContentType = p.contentType(file)
+
+	if p.Config.ACLSidecars {
+		acl, err := p.fileACL(file)
+
+		if err != nil {
+			return err
+		}
+
+		w.ACL = acl
+	} else if len(p.aclMap) > 0 {
+		_, w.ACL = p.aclRules(file)
+	}
+
+	if enc, ok := p.encoding(file); ok {
+		w.ContentEncoding = enc
+	}
+
+	var src io.Reader = r
+	var pr *progressReader
+
+	if p.Config.Progress {
+		pr = p.newProgressReader(r, dst)
+		src = pr
+	}
+
+	if _, err = io.Copy(w, src); err != nil {
+		cancel()
+	} else {
+		err = w.Close()
+	}
+
+	// the bytes of a failed attempt are counted again by the next one
+	if err != nil && pr != nil {
+		pr.discard()
+	}
+
+	if err == nil && p.Config.LogHashes {
+		p.logHashes(dst, w.ContentEncoding, w.Attrs())
+	}
+
+	var gerr *googleapi.Error
+	if p.Config.NoClobber && errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		return errExists
+	}
+
+	return err
+}
+
+// aclEntityPattern matches the ACL entities accepted by GCS.
+var aclEntityPattern = regexp.MustCompile(`^(allUsers|allAuthenticatedUsers|(user|group|domain)-.+|project-(owners|editors|viewers)-.+)$`)
+
+// parseACLs parses the entity:role rules.
+//
+// Rules are merged by entity, the last role specified for an entity wins,
+// and returned sorted by entity so the object ACL is deterministic.
+// The error lists every malformed rule.
+func parseACLs(rules []string) ([]storage.ACLRule, error) {
+	roles := make(map[storage.ACLEntity]storage.ACLRole, len(rules))
+
+	var invalid []string
+
+	for _, s := range rules {
+		a := strings.SplitN(s, ":", 2)
+
+		switch {
+		case len(a) != 2:
+			invalid = append(invalid, fmt.Sprintf("%q (want entity:role)", s))
+			continue
+		case !aclEntityPattern.MatchString(a[0]):
+			invalid = append(invalid, fmt.Sprintf("%q (unknown entity %s)", s, a[0]))
+			continue
+		}
+
+		switch role := storage.ACLRole(a[1]); role {
+		case storage.RoleReader, storage.RoleWriter, storage.RoleOwner:
+			roles[storage.ACLEntity(a[0])] = role
+		default:
+			invalid = append(invalid, fmt.Sprintf("%q (unknown role %s, want READER, WRITER or OWNER)", s, a[1]))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return nil, errors.Errorf("invalid ACL %s", strings.Join(invalid, ", "))
+	}
+
+	var acl []storage.ACLRule
+
+	for entity, role := range roles {
+		acl = append(acl, storage.ACLRule{Entity: entity, Role: role})
+	}
+
+	sort.Slice(acl, func(i, j int) bool {
+		return acl[i].Entity < acl[j].Entity
+	})
+
+	return acl, nil
+}
+
+// unchanged reports whether the object dst already holds
+// the content that would be uploaded from file.
+//
+// The CRC32C of the object is compared to the one of the uploaded stream,
+// which is compressed when file matches p.Gzip or p.Brotli. Compression is
+// deterministic so an unchanged file yields the same compressed bytes.
+func (p *Plugin) unchanged(ctx context.Context, dst, file string) (bool, error) {
+	attrs, err := p.bucket.Object(dst).Attrs(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrap(err, "error reading object attributes")
+	}
+
+	r, enc, err := p.compressor(file)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer r.Close()
+
+	if enc != "" && enc != attrs.ContentEncoding {
+		return false, nil
+	}
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.Copy(h, r)
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == attrs.Size && h.Sum32() == attrs.CRC32C, nil
+}
+
+// mimeTypes are the types of common web files missing from the mime
+// database of minimal images, which lack /etc/mime.types.
+var mimeTypes = map[string]string{
+	".avif":        "image/avif",
+	".map":         "application/json",
+	".mjs":         "text/javascript",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+var registerMimeTypes sync.Once
+
+// addMimeTypes registers mimeTypes with the mime package, unless
+// the system database already knows the extension.
+// p.ContentTypeMap still takes precedence over these types.
+func addMimeTypes() {
+	for ext, t := range mimeTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, t)
+		}
+	}
+}
+
+// contentType returns the Content-Type of the object uploaded from file.
+// p.ContentTypeMap takes precedence over the mime package, which is skipped
+// when p.DisableContentTypeDetection is set.
+func (p *Plugin) contentType(file string) string {
+	ext := filepath.Ext(file)
+
+	// pre-encoded files are typed after their original name, e.g. app.js.br
+	if _, ok := p.encoding(file); ok {
+		ext = filepath.Ext(strings.TrimSuffix(file, ext))
+	}
+
+	if t, ok := p.Config.ContentTypeMap[normalizeExt(ext)]; ok {
+		return t
+	}
+
+	if p.Config.DisableContentTypeDetection {
+		return p.defaultContentType()
+	}
+
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+
+	return p.defaultContentType()
+}
+
+// defaultContentType returns the Content-Type of the files of unknown type.
+func (p *Plugin) defaultContentType() string {
+	if p.Config.DefaultContentType != "" {
+		return p.Config.DefaultContentType
+	}
+
+	return "application/octet-stream"
+}
+
+// encoding returns the Content-Encoding of a pre-encoded file,
+// looked up by extension in p.EncodingMap.
+func (p *Plugin) encoding(file string) (string, bool) {
+	enc, ok := p.Config.EncodingMap[normalizeExt(filepath.Ext(file))]
+	return enc, ok
+}
+
+// normalizeExt returns the lowercased extension without its leading dot.
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// normalizeExtMap returns a copy of m with normalized extension keys.
+func normalizeExtMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	normalized := make(map[string]string, len(m))
+
+	for ext, v := range m {
+		normalized[normalizeExt(ext)] = v
+	}
+
+	return normalized
+}
+
+// mergeMetadata returns a new map holding the entries of all the given maps.
+// Later maps take precedence over earlier ones.
+func mergeMetadata(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+// envVarPattern matches the ${VAR} placeholders of metadata values
+// and rename templates, and the $$ escaping a literal $.
+var envVarPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandMetadata returns a copy of md with the ${VAR} placeholders of its
+// values replaced by the environment variables. Unset variables expand to
+// an empty string, with a warning.
+func (p *Plugin) expandMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+
+	expanded := make(map[string]string, len(md))
+
+	for k, v := range md {
+		expanded[k] = p.expandEnv("metadata "+k, v)
+	}
+
+	return expanded
+}
+
+// expandEnv returns s with its ${VAR} placeholders replaced by the environment
+// variables, warning about the unset ones in the context of what.
+func (p *Plugin) expandEnv(what, s string) string {
+	return envVarPattern.ReplaceAllStringFunc(s, func(s string) string {
+		if s == "$$" {
+			return "$"
+		}
+
+		name := s[2 : len(s)-1]
+		value, ok := os.LookupEnv(name)
+
+		if !ok {
+			p.printf("warning: %s: %s is not set", what, name)
+		}
+
+		return value
+	})
+}
+
+// Content-Encoding of the compressed streams.
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+// compressor returns a stream of file and the Content-Encoding
+// the stream is compressed with, or an empty string if it is not.
+//
+// The compression is selected by p.fileCompression.
+func (p *Plugin) compressor(file string) (io.ReadCloser, string, error) {
+	r, err := os.Open(file)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	fi, err := r.Stat()
+
+	if err != nil {
+		r.Close()
+		return nil, "", err
+	}
+
+	enc := p.fileCompression(file, fi.Size())
+
+	return p.compress(r, enc, file), enc, nil
+}
+
+// compress returns the content of r compressed with enc, or r when enc is empty.
+// With p.VerifyGzip gzipped content is checked against file, unless it is empty.
+func (p *Plugin) compress(r io.ReadCloser, enc, file string) io.ReadCloser {
+	if enc == "" {
+		return r
+	}
+
+	pr, pw := io.Pipe()
+
+	var (
+		dst    io.Writer = pw
+		vw     *io.PipeWriter
+		verify chan error
+	)
+
+	// the compressed stream is also decompressed and compared to the file
+	if p.Config.VerifyGzip && enc == encodingGzip && file != "" {
+		var vr *io.PipeReader
+		vr, vw = io.Pipe()
+		dst = io.MultiWriter(pw, vw)
+		verify = make(chan error, 1)
+
+		go func() {
+			err := verifyGzip(vr, file)
+			vr.CloseWithError(err)
+			verify <- err
+		}()
+	}
+
+	var w io.WriteCloser
+
+	switch enc {
+	case encodingBrotli:
+		w = brotli.NewWriter(dst)
+	default:
+		w = gzip.NewWriter(dst)
+	}
+
+	go func() {
+		defer r.Close()
+
+		if p.compressSlots != nil {
+			p.compressSlots <- struct{}{}
+			defer func() { <-p.compressSlots }()
+		}
+
+		_, err := io.Copy(w, r)
+
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+
+		if verify != nil {
+			vw.CloseWithError(err)
+
+			if verr := <-verify; verr != nil {
+				err = verr
+			}
+		}
+
+		// a failed compression must fail the upload rather than truncate it
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// verifyGzip returns an error unless the gzip stream r
+// decompresses to the content of file.
+func verifyGzip(r io.Reader, file string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "gzip verification failed")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a := make([]byte, 32*1024)
+	b := make([]byte, len(a))
+
+	for {
+		n, errA := io.ReadFull(zr, a)
+		m, errB := io.ReadFull(f, b)
+
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return errors.Wrap(errA, "gzip verification failed")
+		}
+
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return errB
+		}
+
+		if n != m || !bytes.Equal(a[:n], b[:m]) {
+			return errors.New("gzip verification failed: decompressed content differs from the file")
+		}
+
+		if errA != nil || errB != nil {
+			return nil
+		}
+	}
+}
+
+// compression returns the Content-Encoding file is compressed with during
+// upload: br if p.Brotli contains its extension, gzip if p.Gzip does.
+func (p *Plugin) compression(file string) string {
+	switch {
+	case p.matchBrotli(file):
+		return encodingBrotli
+	case p.matchGzip(file):
+		return encodingGzip
+	}
+
+	return ""
+}
+
+// fileCompression returns the compression of file, of size bytes: that
+// of p.compression, except that files smaller than p.GzipMinSize are not
+// gzipped, gaining too little from it if not growing.
+func (p *Plugin) fileCompression(file string, size int64) string {
+	enc := p.compression(file)
+
+	if enc == encodingGzip && size < p.Config.GzipMinSize {
+		return ""
+	}
+
+	return enc
+}
+
+// matchGzip reports whether the file should be gzip-compressed during upload.
+// Compressed files should be uploaded with "gzip" content-encoding.
+func (p *Plugin) matchGzip(file string) bool {
+	return (p.matchCompress(p.Config.Gzip, file) || p.matchGzipContentType(file)) && !p.matchNoGzip(file)
+}
+
+// matchGzipContentType reports whether the content type of file,
+// parameters aside, is one of p.GzipContentTypes.
+func (p *Plugin) matchGzipContentType(file string) bool {
+	if len(p.Config.GzipContentTypes) == 0 {
+		return false
+	}
+
+	if _, ok := p.encoding(file); ok {
+		return false
+	}
+
+	t, _, err := mime.ParseMediaType(p.contentType(file))
+
+	if err != nil {
+		return false
+	}
+
+	for _, gt := range p.Config.GzipContentTypes {
+		if strings.EqualFold(strings.TrimSpace(gt), t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchNoGzip reports whether the path of file relative to p.Source,
+// or one of its parent directories, matches a p.NoGzipGlob pattern.
+func (p *Plugin) matchNoGzip(file string) bool {
+	if len(p.Config.NoGzipGlob) == 0 {
+		return false
+	}
+
+	rel, err := filepath.Rel(p.Config.Source, file)
+
+	if err != nil {
+		return false
+	}
 
-		// Destination to copy files to, including bucket name
-		Target string
+	for rel = filepath.ToSlash(rel); rel != "." && rel != ".."; rel = path.Dir(rel) {
+		for _, pattern := range p.Config.NoGzipGlob {
+			if ok, _ := path.Match(pattern, rel); ok {
+				return true
+			}
+		}
+	}
 
-		// if true, plugin is set to download mode, which means `source` from the bucket will be downloaded
-		Download bool
+	return false
+}
 
-		// Exclude files matching this pattern.
-		Ignore string
+// matchBrotli reports whether the file should be brotli-compressed during upload.
+func (p *Plugin) matchBrotli(file string) bool {
+	return p.matchCompress(p.Config.Brotli, file)
+}
 
-		Gzip         []string
-		CacheControl string
-		Metadata     map[string]string
+// matchCompress reports whether the sorted exts list contains the file extension.
+// Pre-encoded files never match as they are uploaded verbatim.
+func (p *Plugin) matchCompress(exts []string, file string) bool {
+	ext := filepath.Ext(file)
 
-		// OIDC Config
-		workloadPoolId      string
-		providerId          string
-		gcpProjectId        string
-		serviceAccountEmail string
-		OidcIdToken         string
+	if ext == "" {
+		return false
 	}
 
-	Plugin struct {
-		Config Config
+	if _, ok := p.encoding(file); ok {
+		return false
+	}
 
-		bucket *storage.BucketHandle
+	ext = ext[1:]
+	i := sort.SearchStrings(exts, ext)
 
-		printf func(string, ...interface{})
-		fatalf func(string, ...interface{})
+	return i < len(exts) && exts[i] == ext
+}
 
-		ecodeMu sync.Mutex
-		ecode   int
+// validatePattern checks the syntax of a filepath.Match pattern,
+// so that a typo is reported before any file is processed.
+func validatePattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%q: %v", pattern, err)
 	}
-)
 
-// maxConcurrent is the highest upload concurrency.
-// It cannot be 0.
-const maxConcurrent = 100
+	return nil
+}
 
-// Exec executes the plugin
-func (p *Plugin) Exec(client *storage.Client) error {
-	sort.Strings(p.Config.Gzip)
-	rand.Seed(time.Now().UnixNano()) //nolint: staticcheck
+// walkFiles creates a complete set of files to upload
+// by walking p.Source recursively.
+//
+// It excludes files matching the ignore patterns and, when there are
+// include patterns, files matching none of them. Files larger than
+// p.MaxFileSize are skipped or fail the walk, after p.MaxFileSizeAction.
+// Symbolic links are handled after p.Symlinks, see resolveSymlink. Patterns are matched
+// against a partial file name, relative to p.Source. The files are sorted by path.
+func (p *Plugin) walkFiles() ([]string, error) {
+	var items, oversized []string
 
-	p.printf = log.Printf
-	p.fatalf = log.Fatalf
+	var walk filepath.WalkFunc
 
-	// extract bucket name from the target path
-	tgt := strings.SplitN(p.Config.Target, "/", 2)
-	bname := tgt[0]
+	walk = func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
-	if len(tgt) == 1 {
-		p.Config.Target = ""
-	} else {
-		p.Config.Target = tgt[1]
-	}
+		rel, err := filepath.Rel(p.Config.Source, path)
 
-	p.bucket = client.Bucket(strings.Trim(bname, "/"))
+		if err != nil {
+			return err
+		}
 
-	// If in download mode, call the Download method
-	if p.Config.Download {
-		bname, remainingPath := extractBucketName(p.Config.Source)
-		p.Config.Source = remainingPath
+		// hidden directories are not walked at all
+		if p.Config.SkipHidden && isHidden(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
 
-		p.bucket = client.Bucket(strings.Trim(bname, "/"))
+			return nil
+		}
 
-		log.Println("Downloading objects from bucket: ", bname, " using path: ", remainingPath)
+		if fi.IsDir() {
+			return nil
+		}
 
-		ctx := context.Background()
-		query := &storage.Query{Prefix: p.Config.Source}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, err = p.resolveSymlink(path, rel)
 
-		return p.downloadObjects(ctx, query)
-	}
+			if err != nil || fi == nil {
+				return err
+			}
 
-	// create a list of files to upload
-	if !strings.HasPrefix(p.Config.Source, "/") {
-		pwd, err := os.Getwd()
+			// a trailing separator makes Walk go through the link
+			if fi.IsDir() {
+				return filepath.Walk(path+string(filepath.Separator), walk)
+			}
+		}
 
-		if err != nil {
-			return errors.Wrap(err, "failed to get working dir")
+		if p.shouldIgnoreFile(rel) || !p.shouldIncludeFile(rel) {
+			return nil
 		}
 
-		p.printf("source path relative to %s", pwd)
-		p.Config.Source = filepath.Join(pwd, p.Config.Source)
-	}
+		if p.Config.ACLSidecars && isACLSidecar(path) {
+			return nil
+		}
 
-	src, err := p.walkFiles()
+		if limit := p.Config.MaxFileSize; limit > 0 && fi.Size() > limit {
+			if p.Config.MaxFileSizeAction == maxFileSizeFail {
+				oversized = append(oversized, rel)
+				return nil
+			}
 
-	if err != nil {
-		p.fatalf("local files: %v", err)
+			p.printf("%s: skipped, %d bytes exceeds the max file size of %d bytes", rel, fi.Size(), limit)
+			return nil
+		}
+
+		items = append(items, path)
+		return nil
 	}
 
-	// result contains upload result of a single file
-	type result struct {
-		name string
-		err  error
+	err := filepath.Walk(p.Config.Source, walk)
+
+	if err == nil && len(oversized) > 0 {
+		err = errors.Errorf("files larger than %d bytes: %s", p.Config.MaxFileSize, strings.Join(oversized, ", "))
 	}
 
-	// upload all files in a goroutine, maxConcurrent at a time
-	buf := make(chan struct{}, maxConcurrent)
-	res := make(chan *result, len(src))
+	// in path order whatever the walk order, e.g. through followed links,
+	// so that logs, archives and composed objects are reproducible
+	sort.Strings(items)
 
-	for _, f := range src {
-		buf <- struct{}{} // alloc one slot
+	return items, err
+}
 
-		go func(f string) {
-			rel, err := filepath.Rel(p.Config.Source, f)
+// isHidden reports whether one of the elements of the relative path rel,
+// like .git or .DS_Store, starts with a dot.
+func isHidden(rel string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." && elem != ".." {
+			return true
+		}
+	}
 
-			if err != nil {
-				res <- &result{f, err}
-				return
-			}
+	return false
+}
 
-			err = p.uploadFile(path.Join(p.Config.Target, rel), f)
-			res <- &result{rel, err}
+// parseTarget splits the target into the bucket name and the prefix
+// of the objects, without leading or trailing slashes. The prefix is empty
+// for the bucket root, given as bucket or bucket/.
+func parseTarget(target string) (string, string) {
+	bucket, prefix := extractBucketName(strings.TrimLeft(target, "/"))
+	return bucket, strings.Trim(prefix, "/")
+}
 
-			<-buf // free up
-		}(f)
+// extractBucketName extracts the bucket name from the target path.
+func extractBucketName(source string) (string, string) {
+	src := strings.SplitN(source, "/", 2)
+	if len(src) == 1 {
+		return src[0], ""
 	}
+	return src[0], src[1]
+}
 
-	// wait for all files to be uploaded or stop at first error
-	for range src {
-		r := <-res
+// Actions applied to the files larger than Config.MaxFileSize.
+const (
+	maxFileSizeSkip = "skip"
+	maxFileSizeFail = "fail"
+)
 
-		if r.err != nil {
-			p.fatalf("%s: %v", r.name, r.err)
-		}
+// Policies applied by downloads to existing local files.
+const (
+	downloadOverwrite = "overwrite"
+	downloadSkip      = "skip"
+	downloadFail      = "fail"
+)
 
-		p.printf(r.name)
+// keepExisting reports whether an existing destination file is kept
+// instead of being overwritten by the download of an object, as set
+// by p.DownloadExisting. In fail mode an error is returned instead.
+//
+// With p.DownloadCompare only files matching the size of the object and
+// not older than it are kept, others are overwritten.
+func (p *Plugin) keepExisting(destination string, objAttrs *storage.ObjectAttrs) (bool, error) {
+	if p.Config.DownloadExisting == "" || p.Config.DownloadExisting == downloadOverwrite {
+		return false, nil
 	}
 
-	return nil
-}
-
-// errorf sets exit code to a non-zero value and outputs using printf.
-func (p *Plugin) errorf(format string, args ...interface{}) {
-	p.ecodeMu.Lock()
-	p.ecode = 1
-	p.ecodeMu.Unlock()
-	p.printf(format, args...)
-}
+	fi, err := os.Stat(destination)
 
-// uploadFile uploads the file to dst using global bucket.
-// To get a more robust upload use retryUpload instead.
-func (p *Plugin) uploadFile(dst, file string) error {
-	r, gz, err := p.gzipper(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
 
 	if err != nil {
-		return err
+		return false, errors.Wrap(err, "error reading destination file")
 	}
 
-	defer r.Close()
-	rel, err := filepath.Rel(p.Config.Source, file)
+	if p.Config.DownloadCompare && (fi.Size() != objAttrs.Size || fi.ModTime().Before(objAttrs.Updated)) {
+		return false, nil
+	}
 
-	if err != nil {
-		return err
+	if p.Config.DownloadExisting == downloadFail {
+		return false, errors.Errorf("destination file %s already exists", destination)
 	}
 
-	name := path.Join(p.Config.Target, rel)
-	w := p.bucket.Object(name).NewWriter(context.Background())
-	w.CacheControl = p.Config.CacheControl
-	w.Metadata = p.Config.Metadata
+	p.printf("%s: skipped, %s already exists", objAttrs.Name, destination)
+	return true, nil
+}
 
-	for _, s := range p.Config.ACL {
-		a := strings.SplitN(s, ":", 2)
+// downloadPathData holds the variables available to the download template.
+type downloadPathData struct {
+	Name string // full object name
+	Base string // last element of the name
+	Dir  string // name without the last element
+	Ext  string // extension of the name, including the dot
+}
 
-		if len(a) != 2 {
-			return fmt.Errorf("%s: invalid ACL %q", name, s)
-		}
+// parseDownloadTemplate parses the download template and evaluates it
+// against a sample object, so that unknown variables are reported at startup.
+func parseDownloadTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("download").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid download template")
+	}
 
-		w.ACL = append(w.ACL, storage.ACLRule{
-			Entity: storage.ACLEntity(a[0]),
-			Role:   storage.ACLRole(a[1]),
-		})
+	if err := tmpl.Execute(io.Discard, newDownloadPathData("dir/file.txt")); err != nil {
+		return nil, errors.Wrap(err, "invalid download template")
 	}
 
-	w.ContentType = mime.TypeByExtension(filepath.Ext(file))
+	return tmpl, nil
+}
 
-	if w.ContentType == "" {
-		w.ContentType = "application/octet-stream"
+func newDownloadPathData(name string) downloadPathData {
+	return downloadPathData{
+		Name: name,
+		Base: path.Base(name),
+		Dir:  path.Dir(name),
+		Ext:  path.Ext(name),
 	}
+}
 
-	if gz {
-		w.ContentEncoding = "gzip"
+// downloadPath returns the local path an object is downloaded to.
+// Unless a download template is configured it is the object name joined with p.Target.
+func (p *Plugin) downloadPath(name string) (string, error) {
+	if p.downloadTemplate == nil {
+		return filepath.Join(p.Config.Target, name), nil
 	}
 
-	if _, err := io.Copy(w, r); err != nil {
-		return err
+	var buf strings.Builder
+	if err := p.downloadTemplate.Execute(&buf, newDownloadPathData(name)); err != nil {
+		return "", errors.Wrapf(err, "%s: error evaluating download template", name)
 	}
 
-	return w.Close()
+	return filepath.Join(p.Config.Target, filepath.FromSlash(buf.String())), nil
 }
 
-// gzipper returns a stream of file and a boolean indicating
-// whether the stream is gzip-compressed.
-//
-// The stream is compressed if p.Gzip contains file extension.
-func (p *Plugin) gzipper(file string) (io.ReadCloser, bool, error) {
-	r, err := os.Open(file)
-
-	if err != nil || !p.matchGzip(file) {
-		return r, false, err
-	}
+// downloadRetryBackoff is the delay before the first retry of an object
+// reported missing on download. It doubles on every attempt.
+const downloadRetryBackoff = 500 * time.Millisecond
 
-	pr, pw := io.Pipe()
-	w := gzip.NewWriter(pw)
+// openObject opens the named object for reading.
+//
+// Listed objects may briefly be reported missing, so not found errors
+// are retried up to p.DownloadRetries times.
+func (p *Plugin) openObject(ctx context.Context, name string) (*storage.Reader, error) {
+	backoff := downloadRetryBackoff
 
-	go func() {
-		_, err := io.Copy(w, r)
+	for attempt := 0; ; attempt++ {
+		o := p.bucket.Object(name)
 
-		if err != nil {
-			p.errorf("%s: io.Copy: %v", file, err)
+		if p.Config.Generation != 0 {
+			o = o.Generation(p.Config.Generation)
 		}
 
-		if err := w.Close(); err != nil {
-			p.errorf("%s: gzip: %v", file, err)
-		}
+		reader, err := o.NewReader(ctx)
 
-		if err := pw.Close(); err != nil {
-			p.errorf("%s: pipe: %v", file, err)
+		if err != storage.ErrObjectNotExist || attempt >= p.Config.DownloadRetries {
+			return reader, err
 		}
 
-		r.Close()
-	}()
-	return pr, true, nil
+		p.printf("%s: not found, retrying in %s", name, backoff)
+		p.sleep(backoff)
+		backoff *= 2
+	}
 }
 
-// matchGzip reports whether the file should be gzip-compressed during upload.
-// Compressed files should be uploaded with "gzip" content-encoding.
-func (p *Plugin) matchGzip(file string) bool {
-	ext := filepath.Ext(file)
+// generationAttrs returns the attributes of the p.Generation of the object
+// named by source. The source may be the prefix of a single object.
+func (p *Plugin) generationAttrs(ctx context.Context, source string) (*storage.ObjectAttrs, error) {
+	name, err := p.singleObject(ctx, source)
 
-	if ext == "" {
-		return false
+	if err != nil {
+		return nil, errors.Wrapf(err, "generation %d", p.Config.Generation)
 	}
 
-	ext = ext[1:]
-	i := sort.SearchStrings(p.Config.Gzip, ext)
+	objAttrs, err := p.bucket.Object(name).Generation(p.Config.Generation).Attrs(ctx)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "generation %d of %s", p.Config.Generation, name)
+	}
 
-	return i < len(p.Config.Gzip) && p.Config.Gzip[i] == ext
+	return objAttrs, nil
 }
 
-// walkFiles creates a complete set of files to upload
-// by walking p.Source recursively.
-//
-// It excludes files matching p.Ignore pattern.
-// The ignore pattern is matched using filepath.Match against a partial
-// file name, relative to p.Source.
-func (p *Plugin) walkFiles() ([]string, error) {
-	var items []string
+// singleObject returns the name of the object named by source, which may
+// be the prefix of a single object. It is source itself when no live
+// object matches.
+func (p *Plugin) singleObject(ctx context.Context, source string) (string, error) {
+	it := p.bucket.Objects(ctx, &storage.Query{Prefix: source})
 
-	err := filepath.Walk(p.Config.Source, func(path string, fi os.FileInfo, err error) error {
-		if err != nil || fi.IsDir() {
-			return err
-		}
+	var names []string
 
-		rel, err := filepath.Rel(p.Config.Source, path)
+	for {
+		objAttrs, err := it.Next()
 
-		if err != nil {
-			return err
+		if err == iterator.Done {
+			break
 		}
 
-		var ignore bool
-
-		if p.Config.Ignore != "" {
-			ignore, err = filepath.Match(p.Config.Ignore, rel)
+		if err != nil {
+			return "", errors.Wrap(err, "error while iterating through GCS objects")
 		}
 
-		if err != nil || ignore {
-			return err
-		}
+		names = append(names, objAttrs.Name)
+	}
 
-		items = append(items, path)
-		return nil
-	})
+	switch {
+	case len(names) == 1:
+		return names[0], nil
+	case len(names) > 1 && !slices.Contains(names, source):
+		return "", errors.Errorf("source %s matches %d objects, want a single object", source, len(names))
+	}
 
-	return items, err
+	return source, nil
 }
 
-// extractBucketName extracts the bucket name from the target path.
-func extractBucketName(source string) (string, string) {
-	src := strings.SplitN(source, "/", 2)
-	if len(src) == 1 {
-		return src[0], ""
+// downloadStdout writes the single object named by source to p.stdout.
+func (p *Plugin) downloadStdout(ctx context.Context, source string) error {
+	name, err := p.singleObject(ctx, source)
+
+	if err != nil {
+		return err
 	}
-	return src[0], src[1]
+
+	reader, err := p.openObject(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "error opening GCS object for reading")
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(p.stdout, reader); err != nil {
+		return errors.Wrap(err, "error copying GCS object contents to stdout")
+	}
+
+	return nil
 }
 
 // downloadObject downloads a single object from GCS
 func (p *Plugin) downloadObject(ctx context.Context, objAttrs *storage.ObjectAttrs) error {
 	// Create the destination file path
-	destination := filepath.Join(p.Config.Target, objAttrs.Name)
+	destination, err := p.downloadPath(objAttrs.Name)
+	if err != nil {
+		return err
+	}
 	log.Println("Destination: ", destination)
 
+	if keep, err := p.keepExisting(destination, objAttrs); err != nil || keep {
+		return err
+	}
+
 	// Extract the directory from the destination path
 	dir := filepath.Dir(destination)
 
@@ -340,7 +2649,7 @@ func (p *Plugin) downloadObject(ctx context.Context, objAttrs *storage.ObjectAtt
 	defer file.Close()
 
 	// Open the GCS object for reading
-	reader, err := p.bucket.Object(objAttrs.Name).NewReader(ctx)
+	reader, err := p.openObject(ctx, objAttrs.Name)
 	if err != nil {
 		return errors.Wrap(err, "error opening GCS object for reading")
 	}
@@ -352,14 +2661,66 @@ func (p *Plugin) downloadObject(ctx context.Context, objAttrs *storage.ObjectAtt
 		return errors.Wrap(err, "error copying GCS object contents to local file")
 	}
 
+	if p.expectedHashes != nil {
+		file.Close()
+
+		if err := p.checkHash(objAttrs.Name, destination); err != nil {
+			os.Remove(destination)
+			return err
+		}
+	}
+
+	if p.Config.PreserveMtime && !objAttrs.Updated.IsZero() {
+		file.Close()
+
+		if err := os.Chtimes(destination, objAttrs.Updated, objAttrs.Updated); err != nil {
+			return errors.Wrap(err, "error setting modification time of destination file")
+		}
+	}
+
 	return nil
 }
 
 // downloadObjects downloads all objects in the specified GCS bucket path
-func (p *Plugin) downloadObjects(ctx context.Context, query *storage.Query) error {
+func (p *Plugin) downloadObjects(ctx context.Context, query *storage.Query) (rerr error) {
+	if p.Config.Target == stdoutTarget {
+		return p.downloadStdout(ctx, query.Prefix)
+	}
+
+	download := p.downloadObject
+
+	if p.Config.DownloadBundle {
+		b, err := createBundle(p.Config.Target)
+		if err != nil {
+			return err
+		}
+
+		download = func(ctx context.Context, objAttrs *storage.ObjectAttrs) error {
+			return p.bundleObject(ctx, b, objAttrs)
+		}
+
+		defer func() {
+			if err := b.Close(); err != nil && rerr == nil {
+				rerr = errors.Wrap(err, "error writing bundle")
+			}
+		}()
+	}
+
+	if p.Config.Generation != 0 {
+		objAttrs, err := p.generationAttrs(ctx, query.Prefix)
+
+		if err != nil {
+			return err
+		}
+
+		return download(ctx, objAttrs)
+	}
+
 	// List the objects in the specified GCS bucket path
 	it := p.bucket.Objects(ctx, query)
 
+	var listed, filtered, written int
+
 	for {
 		objAttrs, err := it.Next()
 
@@ -371,9 +2732,33 @@ func (p *Plugin) downloadObjects(ctx context.Context, query *storage.Query) erro
 			return errors.Wrap(err, "error while iterating through GCS objects")
 		}
 
-		if err := p.downloadObject(ctx, objAttrs); err != nil {
-			return err
+		listed++
+
+		// directory placeholders have no content to download
+		if strings.HasSuffix(objAttrs.Name, "/") {
+			filtered++
+			continue
+		}
+
+		if rel := strings.TrimLeft(strings.TrimPrefix(objAttrs.Name, query.Prefix), "/"); len(p.downloadFilter) > 0 && !matchAny(p.downloadFilter, rel) {
+			filtered++
+			continue
+		}
+
+		if err := download(ctx, objAttrs); err != nil {
+			if !p.Config.VerifyDownloadCount {
+				return err
+			}
+
+			p.errorf("%s: %v", objAttrs.Name, err)
+			continue
 		}
+
+		written++
+	}
+
+	if p.Config.VerifyDownloadCount && written != listed-filtered {
+		return fmt.Errorf("downloaded %d of %d objects (%d listed, %d filtered)", written, listed-filtered, listed, filtered)
 	}
 
 	return nil
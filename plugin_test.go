@@ -15,23 +15,40 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
@@ -166,6 +183,7 @@ func TestRun(t *testing.T) {
 
 	plugin.Config.Source = wdir + "/upload"
 	plugin.Config.Target = "bucket/dir/"
+	plugin.Config.SkipBucketCheck = true // the transport only serves uploads
 	plugin.Config.Ignore = "sub/*.bin"
 	plugin.Config.Gzip = []string{"js"}
 	plugin.Config.CacheControl = "public,max-age=10"
@@ -308,3 +326,4309 @@ func TestExtractBucketName(t *testing.T) {
 		}
 	}
 }
+
+func TestObjectNameTrimPrefix(t *testing.T) {
+	tests := []struct {
+		rel      string
+		optional bool
+		want     string
+		wantErr  bool
+	}{
+		{rel: "build/web/app.js", want: "dir/app.js"},
+		{rel: "build/web/css/site.css", want: "dir/css/site.css"},
+		{rel: "docs/index.html", wantErr: true},
+		{rel: "docs/index.html", optional: true, want: "dir/docs/index.html"},
+		{rel: "build/website/app.js", wantErr: true},
+		{rel: "build/website/app.js", optional: true, want: "dir/build/website/app.js"},
+	}
+
+	for _, tc := range tests {
+		p := Plugin{Config: Config{
+			Target:             "dir",
+			TrimPrefix:         "build/web",
+			TrimPrefixOptional: tc.optional,
+		}}
+
+		name, err := p.objectName(tc.rel)
+
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("objectName(%q): wanted error", tc.rel)
+		case !tc.wantErr && err != nil:
+			t.Errorf("objectName(%q): %v", tc.rel, err)
+		case name != tc.want:
+			t.Errorf("objectName(%q) = %q; want %q", tc.rel, name, tc.want)
+		}
+	}
+}
+
+// fakeGCS is an in-memory stand-in for the parts of the GCS JSON API
+// used by the plugin.
+type fakeGCS struct {
+	mu      sync.Mutex // guards objects and the in-flight counters
+	objects map[string]*fakeObject
+
+	inflight    int
+	maxInflight int // highest number of concurrent requests seen
+
+	// notFound is the number of times the media of an object
+	// is reported missing before it is served.
+	notFound map[string]int
+
+	// uploadErrors are the status codes of the next failing uploads.
+	uploadErrors []int
+
+	// retryAfter is the Retry-After header of the failing uploads.
+	retryAfter string
+
+	// buckets holds the buckets created, besides the existing bucket.
+	buckets map[string]map[string]string
+
+	// block holds the uploads until it is closed, when not nil.
+	block chan struct{}
+
+	// generations holds the content of the past generations of the objects.
+	generations map[string]map[int64][]byte
+}
+
+type fakeObject struct {
+	attrs storage.ObjectAttrs
+	body  []byte
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{objects: make(map[string]*fakeObject)}
+}
+
+// client returns a storage client talking to the fake.
+func (f *fakeGCS) client(t *testing.T) *storage.Client {
+	hc := &http.Client{Transport: &fakeTransport{f.roundTrip}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// object returns the stored object, or nil if it does not exist.
+func (f *fakeGCS) object(name string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[name]
+}
+
+func (f *fakeGCS) roundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.inflight++
+	if f.inflight > f.maxInflight {
+		f.maxInflight = f.inflight
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.inflight--
+		f.mu.Unlock()
+	}()
+
+	const objects = "/storage/v1/b/bucket/o"
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket":
+		return fakeResponse(http.StatusOK, `{"name": "bucket"}`), nil
+	case r.Method == http.MethodPost && r.URL.Path == "/storage/v1/b":
+		return f.createBucket(r)
+	case r.Method == http.MethodGet && strings.Count(r.URL.Path, "/") == 4 && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		return fakeResponse(http.StatusNotFound, `{"error": {"code": 404, "message": "not found"}}`), nil
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/"):
+		return f.upload(r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, objects+"/") && strings.HasSuffix(r.URL.Path, "/compose"):
+		return f.compose(r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, objects+"/"), "/compose"))
+	case r.Method == http.MethodGet && r.URL.Path == objects:
+		return f.list(r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, objects+"/"):
+		return f.attrs(strings.TrimPrefix(r.URL.Path, objects+"/"), r.URL.Query().Get("generation"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, objects+"/"):
+		return f.delete(strings.TrimPrefix(r.URL.Path, objects+"/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/bucket/"):
+		return f.media(strings.TrimPrefix(r.URL.Path, "/bucket/"), r.URL.Query().Get("generation"))
+	}
+	return fakeResponse(http.StatusNotImplemented, `{}`), nil
+}
+
+// put stores an object as if it had been uploaded.
+func (f *fakeGCS) put(name string, body []byte) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := &fakeObject{
+		attrs: storage.ObjectAttrs{
+			Bucket:  "bucket",
+			Name:    name,
+			Size:    int64(len(body)),
+			Updated: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		body: body,
+	}
+	f.objects[name] = obj
+	return obj
+}
+
+func (f *fakeGCS) list(r *http.Request) (*http.Response, error) {
+	prefix := r.URL.Query().Get("prefix")
+
+	f.mu.Lock()
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		attrs := f.objects[name].attrs
+		items = append(items, map[string]string{
+			"bucket":  "bucket",
+			"name":    name,
+			"size":    fmt.Sprint(attrs.Size),
+			"updated": attrs.Updated.Format(time.RFC3339Nano),
+		})
+	}
+	f.mu.Unlock()
+
+	b, _ := json.Marshal(map[string]interface{}{"kind": "storage#objects", "items": items})
+	return fakeResponse(http.StatusOK, string(b)), nil
+}
+
+func (f *fakeGCS) attrs(name, generation string) (*http.Response, error) {
+	obj := f.object(name)
+	if generation != "" {
+		obj = f.generation(name, generation)
+	}
+	if obj == nil {
+		return fakeResponse(http.StatusNotFound, `{"error": {"code": 404, "message": "not found"}}`), nil
+	}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(obj.body, crc32.MakeTable(crc32.Castagnoli)))
+	b, _ := json.Marshal(map[string]string{
+		"bucket":          "bucket",
+		"name":            name,
+		"size":            fmt.Sprint(obj.attrs.Size),
+		"contentEncoding": obj.attrs.ContentEncoding,
+		"crc32c":          base64.StdEncoding.EncodeToString(crc),
+	})
+	return fakeResponse(http.StatusOK, string(b)), nil
+}
+
+// generation returns the object holding the content of a past generation,
+// or nil if it does not exist.
+func (f *fakeGCS) generation(name, generation string) *fakeObject {
+	gen, _ := strconv.ParseInt(generation, 10, 64)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.generations[name][gen]
+	if !ok {
+		return nil
+	}
+	return &fakeObject{
+		attrs: storage.ObjectAttrs{Bucket: "bucket", Name: name, Size: int64(len(body)), Generation: gen},
+		body:  body,
+	}
+}
+
+// createBucket records the bucket of the request, with its project.
+func (f *fakeGCS) createBucket(r *http.Request) (*http.Response, error) {
+	var req struct{ Name, Location string }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{"name": req.Name, "location": req.Location, "project": r.URL.Query().Get("project")}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets == nil {
+		f.buckets = make(map[string]map[string]string)
+	}
+	f.buckets[attrs["name"]] = attrs
+	return fakeResponse(http.StatusOK, fmt.Sprintf(`{"name": %q}`, attrs["name"])), nil
+}
+
+// compose concatenates the source objects of the request into the object name.
+func (f *fakeGCS) compose(r *http.Request, name string) (*http.Response, error) {
+	var req struct {
+		SourceObjects []struct{ Name string }
+		Destination   struct {
+			ContentType   string
+			CacheControl  string
+			StorageClass  string
+			TemporaryHold bool
+			Acl           []struct{ Entity, Role string }
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	if r.URL.Query().Get("ifGenerationMatch") == "0" && f.object(name) != nil {
+		return fakeResponse(http.StatusPreconditionFailed, `{"error": {"code": 412, "message": "conditionNotMet"}}`), nil
+	}
+
+	var body []byte
+	for _, src := range req.SourceObjects {
+		obj := f.object(src.Name)
+		if obj == nil {
+			return fakeResponse(http.StatusNotFound, `{"error": {"code": 404, "message": "not found"}}`), nil
+		}
+		body = append(body, obj.body...)
+	}
+
+	obj := f.put(name, body)
+	obj.attrs.ContentType = req.Destination.ContentType
+	obj.attrs.CacheControl = req.Destination.CacheControl
+	obj.attrs.StorageClass = req.Destination.StorageClass
+	obj.attrs.TemporaryHold = req.Destination.TemporaryHold
+	obj.attrs.PredefinedACL = r.URL.Query().Get("destinationPredefinedAcl")
+	for _, a := range req.Destination.Acl {
+		obj.attrs.ACL = append(obj.attrs.ACL, storage.ACLRule{Entity: storage.ACLEntity(a.Entity), Role: storage.ACLRole(a.Role)})
+	}
+	return fakeResponse(http.StatusOK, fmt.Sprintf(`{"bucket": "bucket", "name": %q}`, name)), nil
+}
+
+func (f *fakeGCS) delete(name string) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.objects[name]; !ok {
+		return fakeResponse(http.StatusNotFound, `{"error": {"code": 404, "message": "not found"}}`), nil
+	}
+	delete(f.objects, name)
+	return fakeResponse(http.StatusNoContent, ""), nil
+}
+
+func (f *fakeGCS) media(name, generation string) (*http.Response, error) {
+	f.mu.Lock()
+	missing := f.notFound[name] > 0
+	if missing {
+		f.notFound[name]--
+	}
+	f.mu.Unlock()
+
+	obj := f.object(name)
+	if generation != "" {
+		obj = f.generation(name, generation)
+	}
+	if obj == nil || missing {
+		return fakeResponse(http.StatusNotFound, "not found"), nil
+	}
+	res := fakeResponse(http.StatusOK, string(obj.body))
+	res.ContentLength = int64(len(obj.body))
+	return res, nil
+}
+
+func (f *fakeGCS) upload(r *http.Request) (*http.Response, error) {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.mu.Lock()
+	if len(f.uploadErrors) > 0 {
+		code := f.uploadErrors[0]
+		f.uploadErrors = f.uploadErrors[1:]
+		f.mu.Unlock()
+		res := fakeResponse(code, fmt.Sprintf(`{"error": {"code": %d, "message": "failed"}}`, code))
+		if f.retryAfter != "" {
+			res.Header.Set("Retry-After", f.retryAfter)
+		}
+		return res, nil
+	}
+	if r.URL.Query().Get("ifGenerationMatch") == "0" && f.objects[r.URL.Query().Get("name")] != nil {
+		f.mu.Unlock()
+		return fakeResponse(http.StatusPreconditionFailed, `{"error": {"code": 412, "message": "conditionNotMet"}}`), nil
+	}
+	f.mu.Unlock()
+
+	_, mp, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(r.Body, mp["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	var attrs storage.ObjectAttrs
+	if err := json.NewDecoder(p).Decode(&attrs); err != nil {
+		return nil, err
+	}
+	if p, err = mr.NextPart(); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(p)
+	if err != nil {
+		return nil, err
+	}
+	attrs.Size = int64(len(body))
+	if k := r.URL.Query().Get("kmsKeyName"); k != "" {
+		attrs.KMSKeyName = k
+	}
+	if a := r.URL.Query().Get("predefinedAcl"); a != "" {
+		attrs.PredefinedACL = a
+	}
+
+	f.mu.Lock()
+	f.objects[attrs.Name] = &fakeObject{attrs: attrs, body: body}
+	f.mu.Unlock()
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)))
+	sum := md5.Sum(body)
+	b, _ := json.Marshal(map[string]interface{}{
+		"name":    attrs.Name,
+		"size":    fmt.Sprint(attrs.Size),
+		"crc32c":  base64.StdEncoding.EncodeToString(crc),
+		"md5Hash": base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	return fakeResponse(http.StatusOK, string(b)), nil
+}
+
+func fakeResponse(code int, body string) *http.Response {
+	return &http.Response{
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		StatusCode: code,
+		Header:     make(http.Header),
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "a.txt", []byte("a"))
+	writeFile(t, wdir, "b.txt", []byte("b"))
+
+	var out bytes.Buffer
+	p := Plugin{
+		Config: Config{
+			Source:      wdir,
+			Target:      "bucket/dir",
+			Annotations: "github",
+		},
+		stdout: &out,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "::notice title=gcs::uploaded 2 files to gs://bucket/dir\n"
+	if got := out.String(); got != want {
+		t.Errorf("annotations = %q; want %q", got, want)
+	}
+	if fake.object("dir/a.txt") == nil || fake.object("dir/b.txt") == nil {
+		t.Errorf("files were not uploaded")
+	}
+}
+
+func TestUploadVanishedFile(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "gone.txt", []byte("gone"))
+
+	p := Plugin{Config: Config{Source: wdir}}
+	src, err := p.walkFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(src[0]); err != nil {
+		t.Fatal(err)
+	}
+	p.bucket = newFakeGCS().client(t).Bucket("bucket")
+
+	if err := p.uploadFile("gone.txt", src[0]); err == nil || errors.Is(err, errVanished) {
+		t.Errorf("uploadFile = %v; want a not exist error", err)
+	}
+
+	p.Config.SkipVanished = true
+	if err := p.uploadFile("gone.txt", src[0]); !errors.Is(err, errVanished) {
+		t.Errorf("uploadFile = %v; want %v", err, errVanished)
+	}
+}
+
+func TestGzipMetadata(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+	writeFile(t, wdir, "app.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source:           wdir,
+		Target:           "bucket",
+		Gzip:             []string{"js"},
+		CacheControl:     "public,max-age=10",
+		Metadata:         map[string]string{"x-foo": "bar"},
+		GzipMetadata:     map[string]string{"x-compressed": "yes"},
+		GzipCacheControl: "public,max-age=60,no-transform",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	gz := fake.object("app.js")
+	if gz == nil {
+		t.Fatal("app.js was not uploaded")
+	}
+	wantMeta := map[string]string{"x-foo": "bar", "x-compressed": "yes"}
+	if !reflect.DeepEqual(gz.attrs.Metadata, wantMeta) {
+		t.Errorf("app.js metadata = %v; want %v", gz.attrs.Metadata, wantMeta)
+	}
+	if gz.attrs.CacheControl != p.Config.GzipCacheControl {
+		t.Errorf("app.js CacheControl = %q; want %q", gz.attrs.CacheControl, p.Config.GzipCacheControl)
+	}
+
+	plain := fake.object("app.txt")
+	if plain == nil {
+		t.Fatal("app.txt was not uploaded")
+	}
+	if !reflect.DeepEqual(plain.attrs.Metadata, p.Config.Metadata) {
+		t.Errorf("app.txt metadata = %v; want %v", plain.attrs.Metadata, p.Config.Metadata)
+	}
+	if plain.attrs.CacheControl != p.Config.CacheControl {
+		t.Errorf("app.txt CacheControl = %q; want %q", plain.attrs.CacheControl, p.Config.CacheControl)
+	}
+}
+
+func TestInvalidIgnorePattern(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket",
+		Ignore: "[",
+	}}
+
+	fake := newFakeGCS()
+	err := p.Exec(fake.client(t))
+	if err == nil || !strings.Contains(err.Error(), "invalid ignore pattern") {
+		t.Errorf("Exec = %v; want invalid ignore pattern error", err)
+	}
+	if fake.object("file.txt") != nil {
+		t.Errorf("file.txt was uploaded despite the invalid pattern")
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "tmp")
+	writeFile(t, wdir, "app.log", []byte("log"))
+	writeFile(t, wdir, "keep.txt", []byte("text"))
+	writeFile(t, wdir, "tmp/cache.txt", []byte("cache"))
+
+	ignoreFile := filepath.Join(t.TempDir(), ".gcsignore")
+	if err := os.WriteFile(ignoreFile, []byte("# build leftovers\n*.log\n\ntmp/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Plugin{Config: Config{
+		Source:     wdir,
+		Target:     "bucket",
+		IgnoreFile: ignoreFile,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if fake.object("keep.txt") == nil {
+		t.Errorf("keep.txt was not uploaded")
+	}
+	for _, name := range []string{"app.log", "tmp/cache.txt"} {
+		if fake.object(name) != nil {
+			t.Errorf("%s was uploaded despite the ignore file", name)
+		}
+	}
+}
+
+func TestSplitPatterns(t *testing.T) {
+	got := splitPatterns("*.log, dist/{js,css}/*.map,,{a,b{c,d}}")
+	want := []string{"*.log", "dist/{js,css}/*.map", "{a,b{c,d}}"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitPatterns = %q; want %q", got, want)
+	}
+}
+
+func TestShouldIgnoreFile(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "logs/app.log", false},
+		{"logs", "logs/app.log", false},
+		{"logs/", "logs/app.log", true},
+		{"logs/", "logs", false},
+		{"a*", "abc/file.txt", false},
+		{"a*", "abc.txt", true},
+		{"*", "dir/file.txt", false},
+		{"*", "file.txt", true},
+		{"*/", "dir/sub/file.txt", true},
+		{"**/*.map", "app.map", true},
+		{"**/*.map", "js/vendor/app.map", true},
+		{"**/*.map", "js/app.js", false},
+		{"build/**/*.map", "build/app.map", true},
+		{"build/**/*.map", "build/js/app.map", true},
+		{"build/**/*.map", "src/build/app.map", false},
+		{"node_modules/**", "node_modules/lib/index.js", true},
+		{"node_modules/**", "node_modules_old/index.js", false},
+		{"node_modules/**", "src/node_modules/index.js", false},
+		{"dist/{js,css}/*", "dist/js/app.js", true},
+		{"dist/{js,css}/*", "dist/css/site.css", true},
+		{"dist/{js,css}/*", "dist/img/logo.png", false},
+		{"*.{js,css}", "site.css", true},
+		{"**/{vendor,lib}/**/*.{map,d.ts}", "js/vendor/jquery/jquery.map", true},
+		{"**/{vendor,lib}/**/*.{map,d.ts}", "lib/index.d.ts", true},
+		{"**/{vendor,lib}/**/*.{map,d.ts}", "src/index.d.ts", false},
+		{"{a,b{c,d}}.txt", "bd.txt", true},
+		{"{a,b{c,d}}.txt", "b.txt", false},
+		{"{unclosed.txt", "{unclosed.txt", true},
+	}
+
+	for _, test := range tests {
+		p := Plugin{ignore: []string{test.pattern}}
+		if got := p.shouldIgnoreFile(test.name); got != test.want {
+			t.Errorf("shouldIgnoreFile(%q) with %q = %v; want %v", test.name, test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "lib")
+	mkdirs(t, wdir, "vendor")
+	writeFile(t, wdir, "app.js", []byte("app"))
+	writeFile(t, wdir, "style.css", []byte("style"))
+	writeFile(t, wdir, "lib/util.js", []byte("util"))
+	writeFile(t, wdir, "vendor/dep.js", []byte("dep"))
+
+	p := Plugin{Config: Config{
+		Source:  wdir,
+		Target:  "bucket",
+		Include: "**/*.js",
+		Ignore:  "vendor/*",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	var got []string
+	for name := range fake.objects {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+
+	want := []string{"app.js", "lib/util.js"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded %v; want %v", got, want)
+	}
+}
+
+func TestMimeTypes(t *testing.T) {
+	registerMimeTypes.Do(addMimeTypes)
+
+	p := Plugin{Config: Config{
+		ContentTypeMap: map[string]string{"webp": "image/x-webp"},
+	}}
+
+	tests := map[string]string{
+		"image.avif":  "image/avif",
+		"module.wasm": "application/wasm",
+		"app.mjs":     "text/javascript",
+		"font.woff2":  "font/woff2",
+		"image.webp":  "image/x-webp",
+		"unknown.zzz": "application/octet-stream",
+	}
+
+	for file, want := range tests {
+		if got := p.contentType(file); !strings.HasPrefix(got, want) {
+			t.Errorf("contentType(%q) = %q; want %q", file, got, want)
+		}
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, size := range []int{0, 8, defaultChunkSize} {
+		p := Plugin{Config: Config{ChunkSize: size}}
+		p.bucket = newFakeGCS().client(t).Bucket("bucket")
+
+		w := p.newWriter(context.Background(), "file.txt", "")
+		if want := size * 1024 * 1024; w.ChunkSize != want {
+			t.Errorf("ChunkSize %d: writer chunk size = %d; want %d", size, w.ChunkSize, want)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	tests := []struct {
+		defaultType string
+		disable     bool
+		file        string
+		want        string
+	}{
+		{"", false, "unknown.zzz", "application/octet-stream"},
+		{"text/plain", false, "unknown.zzz", "text/plain"},
+		{"text/plain", false, "image.png", "image/png"},
+		{"", true, "image.png", "application/octet-stream"},
+		{"application/x-binary", true, "image.png", "application/x-binary"},
+		{"", true, "module.wasm", "application/x-wasm"},
+	}
+
+	for _, tt := range tests {
+		p := Plugin{Config: Config{
+			DefaultContentType:          tt.defaultType,
+			DisableContentTypeDetection: tt.disable,
+			ContentTypeMap:              map[string]string{"wasm": "application/x-wasm"},
+		}}
+		if got := p.contentType(tt.file); got != tt.want {
+			t.Errorf("contentType(%q) with default %q, detection disabled %v = %q; want %q",
+				tt.file, tt.defaultType, tt.disable, got, tt.want)
+		}
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "a.txt", []byte("a"))
+	writeFile(t, wdir, "b.txt", []byte("b"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:          wdir,
+			Target:          "bucket",
+			Concurrency:     1,
+			ContinueOnError: true,
+		},
+		printf: logs.printf,
+		fatalf: func(format string, args ...interface{}) {
+			t.Fatalf("fatalf called: "+format, args...)
+		},
+	}
+
+	fake := newFakeGCS()
+	fake.uploadErrors = []int{http.StatusForbidden}
+
+	err := p.Exec(fake.client(t))
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 files failed to upload: ") {
+		t.Fatalf("Exec = %v; want an error reporting 1 of 2 failed files", err)
+	}
+	if len(fake.objects) != 1 {
+		t.Errorf("%d objects uploaded; want the other file uploaded", len(fake.objects))
+	}
+	if p.exitCode() != 1 {
+		t.Errorf("exit code = %d; want 1", p.exitCode())
+	}
+	if p.summary.Failed != 1 || p.summary.Uploaded != 1 {
+		t.Errorf("summary failed %d, uploaded %d; want 1 and 1", p.summary.Failed, p.summary.Uploaded)
+	}
+}
+
+func TestNoClobber(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "new.txt", []byte("new"))
+	writeFile(t, wdir, "existing.txt", []byte("local"))
+
+	fake := newFakeGCS()
+	fake.put("existing.txt", []byte("remote"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:    wdir,
+			Target:    "bucket",
+			NoClobber: true,
+			Retries:   2,
+		},
+		printf: logs.printf,
+		sleep:  func(time.Duration) {},
+	}
+
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if b := string(fake.object("existing.txt").body); b != "remote" {
+		t.Errorf("existing.txt = %q; want remote", b)
+	}
+	if fake.object("new.txt") == nil {
+		t.Errorf("new.txt was not uploaded")
+	}
+	if lines := logs.with("existing.txt: skipped, object already exists"); len(lines) != 1 {
+		t.Errorf("want a single skip of existing.txt, got logs %q", logs.lines)
+	}
+	if p.summary.Skipped != 1 || p.summary.Uploaded != 1 {
+		t.Errorf("summary skipped %d, uploaded %d; want 1 and 1", p.summary.Skipped, p.summary.Uploaded)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "small.txt", []byte("small"))
+	writeFile(t, wdir, "core", bytes.Repeat([]byte("x"), 100))
+
+	for _, action := range []string{maxFileSizeSkip, maxFileSizeFail} {
+		var logs, failures logLines
+		p := Plugin{
+			Config: Config{
+				Source:            wdir,
+				Target:            "bucket",
+				MaxFileSize:       10,
+				MaxFileSizeAction: action,
+			},
+			printf: logs.printf,
+			fatalf: failures.printf,
+		}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%s: Exec: %v", action, err)
+		}
+
+		if fake.object("core") != nil {
+			t.Errorf("%s: core was uploaded despite its size", action)
+		}
+
+		switch action {
+		case maxFileSizeSkip:
+			if fake.object("small.txt") == nil {
+				t.Errorf("skip: small.txt was not uploaded")
+			}
+			if len(logs.with("core: skipped, 100 bytes exceeds the max file size of 10 bytes")) != 1 {
+				t.Errorf("skip: want core to be logged as skipped, got %q", logs.lines)
+			}
+		case maxFileSizeFail:
+			if want := "local files: files larger than 10 bytes: core"; !reflect.DeepEqual(failures.lines, []string{want}) {
+				t.Errorf("fail: fatal errors %q; want %q", failures.lines, want)
+			}
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	assets := t.TempDir()
+	writeFile(t, assets, "logo.png", []byte("png"))
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "real.txt", []byte("real"))
+	mkdirs(t, wdir, "sub")
+	mkdirs(t, wdir, "a")
+	mkdirs(t, wdir, "b")
+	writeFile(t, wdir, "a/x.txt", []byte("x"))
+	writeFile(t, wdir, "b/y.txt", []byte("y"))
+	for link, target := range map[string]string{
+		"link-file": filepath.Join(wdir, "real.txt"),
+		"link-dir":  assets,
+		"sub/loop":  wdir,
+		// directories linked to each other
+		"a/tob": filepath.Join("..", "b"),
+		"b/toa": filepath.Join("..", "a"),
+	} {
+		if err := os.Symlink(target, filepath.Join(wdir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		policy    string
+		want      []string
+		wantFatal string
+	}{
+		{symlinksSkip, []string{"a/x.txt", "b/y.txt", "real.txt"}, ""},
+		{symlinksFollow, []string{"a/tob/y.txt", "a/x.txt", "b/toa/x.txt", "b/y.txt", "link-dir/logo.png", "link-file", "real.txt"}, ""},
+		{symlinksError, nil, "local files: " + filepath.Join("a", "tob") + ": symbolic links are not allowed"},
+	}
+
+	for _, tt := range tests {
+		var logs, failures logLines
+		p := Plugin{
+			Config: Config{
+				Source:   wdir,
+				Target:   "bucket",
+				Symlinks: tt.policy,
+			},
+			printf: logs.printf,
+			fatalf: failures.printf,
+		}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%s: Exec: %v", tt.policy, err)
+		}
+
+		var got []string
+		for name := range fake.objects {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: uploaded %v; want %v", tt.policy, got, tt.want)
+		}
+		if tt.wantFatal != "" && !reflect.DeepEqual(failures.lines, []string{tt.wantFatal}) {
+			t.Errorf("%s: fatal errors %q; want %q", tt.policy, failures.lines, tt.wantFatal)
+		}
+		if tt.policy != symlinksFollow {
+			continue
+		}
+		for _, link := range []string{"sub/loop", "a/tob/toa", "b/toa/tob"} {
+			if len(logs.with("warning: "+filepath.FromSlash(link)+": skipped")) != 1 {
+				t.Errorf("follow: want %s to be skipped, got logs %q", link, logs.lines)
+			}
+		}
+	}
+}
+
+func TestACLMap(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "public", "img")
+	mkdirs(t, wdir, "config")
+	writeFile(t, wdir, "public/index.html", []byte("index"))
+	writeFile(t, wdir, "public/img/logo.png", []byte("logo"))
+	writeFile(t, wdir, "config/app.yml", []byte("secret"))
+	writeFile(t, wdir, "readme.txt", []byte("readme"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket",
+		ACLMap: map[string][]string{
+			"public/*": {"allUsers:READER"},
+			"*":        {"user-ops@example.com:OWNER"},
+		},
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	public := []storage.ACLRule{{Entity: "allUsers", Role: "READER"}}
+	private := []storage.ACLRule{{Entity: "user-ops@example.com", Role: "OWNER"}}
+	want := map[string][]storage.ACLRule{
+		"public/index.html":   public,
+		"public/img/logo.png": public,
+		"config/app.yml":      private,
+		"readme.txt":          private,
+	}
+	for name, acl := range want {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if !reflect.DeepEqual(obj.attrs.ACL, acl) {
+			t.Errorf("%s ACL = %v; want %v", name, obj.attrs.ACL, acl)
+		}
+	}
+}
+
+func TestDeleteSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		dryRun       bool
+		uploadErrors []int
+		wantDeleted  bool
+	}{
+		{"success", false, nil, true},
+		{"dry run", true, nil, false},
+		{"failure", false, []int{http.StatusForbidden}, false},
+	}
+
+	for _, tt := range tests {
+		wdir := t.TempDir()
+		mkdirs(t, wdir, "a", "b")
+		writeFile(t, wdir, "a/b/file.txt", []byte("text"))
+
+		fake := newFakeGCS()
+		fake.uploadErrors = tt.uploadErrors
+
+		var failures logLines
+		p := Plugin{
+			Config: Config{
+				Source:         wdir,
+				Target:         "bucket",
+				DryRun:         tt.dryRun,
+				DeleteSource:   true,
+				PruneEmptyDirs: true,
+			},
+			fatalf: failures.printf,
+		}
+
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%s: Exec: %v", tt.name, err)
+		}
+
+		_, err := os.Stat(filepath.Join(wdir, "a", "b", "file.txt"))
+		if deleted := os.IsNotExist(err); deleted != tt.wantDeleted {
+			t.Errorf("%s: file deleted = %v; want %v", tt.name, deleted, tt.wantDeleted)
+		}
+
+		_, err = os.Stat(filepath.Join(wdir, "a"))
+		if pruned := os.IsNotExist(err); pruned != tt.wantDeleted {
+			t.Errorf("%s: directories pruned = %v; want %v", tt.name, pruned, tt.wantDeleted)
+		}
+		if _, err := os.Stat(wdir); err != nil {
+			t.Errorf("%s: source removed: %v", tt.name, err)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	wdir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		writeFile(t, wdir, fmt.Sprintf("file%d.txt", i), []byte("text"))
+	}
+
+	p := Plugin{Config: Config{
+		Source:      wdir,
+		Target:      "bucket",
+		Concurrency: 1,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.objects) != 10 {
+		t.Errorf("uploaded %d objects; want 10", len(fake.objects))
+	}
+	if fake.maxInflight != 1 {
+		t.Errorf("max in-flight uploads = %d; want 1", fake.maxInflight)
+	}
+}
+
+func TestConcurrencyDefaults(t *testing.T) {
+	tests := []struct {
+		in, want int
+	}{
+		{0, defaultConcurrency},
+		{-1, defaultConcurrency},
+		{8, 8},
+		{maxConcurrency + 1, maxConcurrency},
+	}
+
+	for _, tc := range tests {
+		p := Plugin{Config: Config{Concurrency: tc.in}}
+		if got := p.concurrency(); got != tc.want {
+			t.Errorf("concurrency(%d) = %d; want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDownloadTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want []string
+	}{
+		{"", []string{"dir/css/site.css", "dir/js/app.js"}},
+		{"{{.Base}}", []string{"app.js", "site.css"}},
+		{"{{.Ext}}/{{.Base}}", []string{".css/site.css", ".js/app.js"}},
+	}
+
+	for _, tc := range tests {
+		wdir := t.TempDir()
+		fake := newFakeGCS()
+		fake.put("dir/js/app.js", []byte("javascript"))
+		fake.put("dir/css/site.css", []byte("style"))
+
+		p := Plugin{Config: Config{
+			Source:           "bucket/dir",
+			Target:           wdir,
+			Download:         true,
+			DownloadTemplate: tc.tmpl,
+		}}
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%q: %v", tc.tmpl, err)
+		}
+
+		var got []string
+		_ = filepath.Walk(wdir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				rel, _ := filepath.Rel(wdir, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: downloaded %v; want %v", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestInvalidDownloadTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{{.Base", "{{.Missing}}"} {
+		if _, err := parseDownloadTemplate(tmpl); err == nil {
+			t.Errorf("parseDownloadTemplate(%q): wanted error", tmpl)
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source:       wdir,
+		Target:       "bucket",
+		StorageClass: "COLDLINE",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("file.txt")
+	if obj == nil {
+		t.Fatal("file.txt was not uploaded")
+	}
+	if obj.attrs.StorageClass != "COLDLINE" {
+		t.Errorf("StorageClass = %q; want COLDLINE", obj.attrs.StorageClass)
+	}
+
+	for class, want := range map[string]bool{"ARCHIVE": true, "coldline": false, "COLD": false} {
+		if got := validStorageClass(class); got != want {
+			t.Errorf("validStorageClass(%q) = %v; want %v", class, got, want)
+		}
+	}
+}
+
+func TestBucketCheck(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	fake := newFakeGCS()
+	p := Plugin{Config: Config{Source: wdir, Target: "typo/dir"}}
+	err := p.Exec(fake.client(t))
+
+	if err == nil || !strings.Contains(err.Error(), "bucket typo does not exist") {
+		t.Errorf("err = %v; want bucket typo does not exist", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("%d objects uploaded; want none", len(fake.objects))
+	}
+
+	p = Plugin{Config: Config{Source: wdir, Target: "bucket/dir"}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("dir/file.txt") == nil {
+		t.Error("dir/file.txt not uploaded")
+	}
+}
+
+func TestDisableClientRetries(t *testing.T) {
+	var requests int32
+	hc := &http.Client{Transport: &fakeTransport{func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return fakeResponse(http.StatusServiceUnavailable, `{"error": {"code": 503, "message": "unavailable"}}`), nil
+	}}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Plugin{Config: Config{Source: t.TempDir(), Target: "bucket", DisableClientRetries: true}}
+	err = p.Exec(client)
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusServiceUnavailable {
+		t.Errorf("err = %v; want the 503 of the bucket check", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests; want 1, not retried", n)
+	}
+}
+
+func TestMaxRetriesPerBucket(t *testing.T) {
+	wdir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		writeFile(t, wdir, fmt.Sprintf("file-%d.txt", i), []byte("text"))
+	}
+
+	var requests int32
+	hc := &http.Client{Transport: &fakeTransport{func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return fakeResponse(http.StatusServiceUnavailable, `{"error": {"code": 503, "message": "unavailable"}}`), nil
+	}}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failures logLines
+	p := Plugin{
+		Config: Config{
+			Source:               wdir,
+			Target:               "bucket",
+			Concurrency:          1,
+			SkipBucketCheck:      true,
+			DisableClientRetries: true,
+			ContinueOnError:      true,
+			MaxRetriesPerBucket:  3,
+		},
+		fatalf: failures.printf,
+	}
+	err = p.Exec(client)
+
+	if err == nil || !strings.Contains(err.Error(), "appears unavailable") {
+		t.Errorf("err = %v; want the bucket to appear unavailable", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("%d requests; want 4, aborted once 3 failed in a row", n)
+	}
+	if p.summary.Failed != 10 {
+		t.Errorf("%d failed; want all 10", p.summary.Failed)
+	}
+}
+
+func TestBreakerRecord(t *testing.T) {
+	p := Plugin{Config: Config{MaxRetriesPerBucket: 1}}
+	b := p.newBreaker()
+	defer b.stop()
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	if b.record(unavailable) {
+		t.Error("tripped after a single failure")
+	}
+	if !b.record(unavailable) || !b.tripped() {
+		t.Error("not tripped after two failures in a row")
+	}
+	if b.context().Err() == nil {
+		t.Error("uploads in flight not cancelled")
+	}
+
+	// an upload which completed anyway is not reported as failed
+	if b.record(nil) {
+		t.Error("successful attempt reported as failed once tripped")
+	}
+	if !b.tripped() {
+		t.Error("breaker reset by a successful attempt")
+	}
+}
+
+func TestCreateBucket(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	fake := newFakeGCS()
+	p := Plugin{Config: Config{
+		Source:         wdir,
+		Target:         "release/dir",
+		CreateBucket:   true,
+		BucketLocation: "EU",
+		ProjectID:      "project",
+	}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{"release": {"name": "release", "location": "EU", "project": "project"}}
+	if !reflect.DeepEqual(fake.buckets, want) {
+		t.Errorf("created buckets %v; want %v", fake.buckets, want)
+	}
+	if fake.object("dir/file.txt") == nil {
+		t.Error("dir/file.txt not uploaded after creating the bucket")
+	}
+
+	p = Plugin{Config: Config{Source: wdir, Target: "other/dir", CreateBucket: true}}
+	if err := p.Exec(fake.client(t)); err == nil || !strings.Contains(err.Error(), "cannot be created without a project ID") {
+		t.Errorf("err = %v; want a missing project ID", err)
+	}
+}
+
+func TestGuardObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		present  bool
+		policy   string
+		wantErr  bool
+		uploaded bool
+	}{
+		{"absent", false, guardSkip, false, true},
+		{"present, skip", true, guardSkip, false, false},
+		{"present, fail", true, guardFail, true, false},
+	}
+
+	for _, tc := range tests {
+		wdir := t.TempDir()
+		writeFile(t, wdir, "file.txt", []byte("text"))
+
+		fake := newFakeGCS()
+		if tc.present {
+			fake.put("locks/deploy", nil)
+		}
+
+		p := Plugin{Config: Config{
+			Source:      wdir,
+			Target:      "bucket",
+			GuardObject: "locks/deploy",
+			GuardPolicy: tc.policy,
+			GuardCreate: true,
+		}}
+		err := p.Exec(fake.client(t))
+
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("%s: wanted error", tc.name)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if got := fake.object("file.txt") != nil; got != tc.uploaded {
+			t.Errorf("%s: uploaded = %v; want %v", tc.name, got, tc.uploaded)
+		}
+		if fake.object("locks/deploy") == nil {
+			t.Errorf("%s: guard object is missing", tc.name)
+		}
+	}
+}
+
+func TestUploadDurations(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "sub")
+	writeFile(t, wdir, "a.txt", []byte("a"))
+	writeFile(t, wdir, "sub/b.txt", []byte("b"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:       wdir,
+			Target:       "bucket",
+			LogDurations: true,
+		},
+		printf: logs.printf,
+	}
+
+	if err := p.Exec(newFakeGCS().client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		lines := logs.with(name + ": uploaded in ")
+		if len(lines) != 1 {
+			t.Errorf("no duration logged for %s", name)
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimPrefix(lines[0], name+": uploaded in "))
+		if err != nil || d < 0 {
+			t.Errorf("%s: duration = %q; want non-negative", name, lines[0])
+		}
+	}
+}
+
+func TestKMSKey(t *testing.T) {
+	const key = "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket",
+		KMSKey: key,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("file.txt")
+	if obj == nil {
+		t.Fatal("file.txt was not uploaded")
+	}
+	if obj.attrs.KMSKeyName != key {
+		t.Errorf("KMSKeyName = %q; want %q", obj.attrs.KMSKeyName, key)
+	}
+
+	for _, k := range []string{"key", "projects/p/cryptoKeys/key", key + "/cryptoKeyVersions/1"} {
+		if validKMSKey(k) {
+			t.Errorf("validKMSKey(%q) = true; want false", k)
+		}
+	}
+}
+
+func TestIgnoreBase(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "web", "tmp")
+	mkdirs(t, wdir, "assets", "tmp")
+	writeFile(t, wdir, "web/app.js", []byte("app"))
+	writeFile(t, wdir, "web/tmp/cache.js", []byte("cache"))
+	writeFile(t, wdir, "assets/lib.js", []byte("lib"))
+	writeFile(t, wdir, "assets/tmp/cache.js", []byte("cache"))
+
+	rules := `[
+		{"source": "` + filepath.Join(wdir, "web") + `", "target": "bucket/site"},
+		{"source": "` + filepath.Join(wdir, "assets") + `", "target": "bucket/static"}
+	]`
+	writeFile(t, wdir, "rules.json", []byte(rules))
+
+	// the patterns name the sources, relative to the shared base
+	p := Plugin{Config: Config{
+		RulesFile:  filepath.Join(wdir, "rules.json"),
+		Ignore:     "web/tmp/,assets/*/cache.js",
+		IgnoreBase: wdir,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	var got []string
+	for name := range fake.objects {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+
+	if want := []string{"site/app.js", "static/lib.js"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded %q; want %q", got, want)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "index.html", []byte("html"))
+	writeFile(t, wdir, "js/app.js", []byte("javascript"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{Source: wdir, Target: "bucket/primary, typo/dir, bucket/backup"},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	err := p.Exec(fake.client(t))
+	if err == nil || err.Error() != "1 of 3 targets failed: typo/dir" {
+		t.Errorf("Exec = %v; want the typo/dir target failed", err)
+	}
+	if got := logs.with("target "); len(got) != 1 || !strings.HasPrefix(got[0], "target typo/dir: ") {
+		t.Errorf("reported failures %q; want typo/dir", got)
+	}
+
+	for _, name := range []string{"primary/index.html", "primary/js/app.js", "backup/index.html", "backup/js/app.js"} {
+		if fake.object(name) == nil {
+			t.Errorf("%s was not uploaded", name)
+		}
+	}
+	if p.summary.Uploaded != 4 {
+		t.Errorf("summary uploaded %d; want 4", p.summary.Uploaded)
+	}
+}
+
+func TestMultipleTargetsUploadFailure(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "index.html", []byte("html"))
+	writeFile(t, wdir, "js/app.js", []byte("javascript"))
+
+	var logs, failures logLines
+	p := Plugin{
+		Config: Config{Source: wdir, Target: "bucket/primary,bucket/backup"},
+		printf: logs.printf,
+		fatalf: failures.printf,
+	}
+
+	// the first upload, to the first target, fails
+	fake := newFakeGCS()
+	fake.uploadErrors = []int{http.StatusForbidden}
+
+	err := p.Exec(fake.client(t))
+	if err == nil || err.Error() != "1 of 2 targets failed: bucket/primary" {
+		t.Errorf("Exec = %v; want the bucket/primary target failed", err)
+	}
+	if len(failures.lines) != 0 {
+		t.Errorf("fatal %q; want the failure reported by its target", failures.lines)
+	}
+	if got := logs.with("target "); len(got) != 1 || !strings.HasPrefix(got[0], "target bucket/primary: ") {
+		t.Errorf("reported failures %q; want bucket/primary", got)
+	}
+
+	for _, name := range []string{"backup/index.html", "backup/js/app.js"} {
+		if fake.object(name) == nil {
+			t.Errorf("%s was not uploaded", name)
+		}
+	}
+}
+
+func TestMultipleTargetsDeleteSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		uploadErrors []int
+		wantDeleted  bool
+	}{
+		{"success", nil, true},
+		{"first target failure", []int{http.StatusForbidden}, false},
+	}
+
+	for _, tt := range tests {
+		wdir := t.TempDir()
+		writeFile(t, wdir, "index.html", []byte("html"))
+
+		fake := newFakeGCS()
+		fake.uploadErrors = tt.uploadErrors
+
+		var logs logLines
+		p := Plugin{
+			Config: Config{Source: wdir, Target: "bucket/primary,bucket/backup", DeleteSource: true},
+			printf: logs.printf,
+			fatalf: logs.printf,
+		}
+
+		err := p.Exec(fake.client(t))
+		if (err != nil) == tt.wantDeleted {
+			t.Errorf("%s: Exec = %v", tt.name, err)
+		}
+
+		// every target gets the file, whether or not a former one failed
+		if fake.object("backup/index.html") == nil {
+			t.Errorf("%s: backup/index.html was not uploaded", tt.name)
+		}
+		if tt.wantDeleted && fake.object("primary/index.html") == nil {
+			t.Errorf("%s: primary/index.html was not uploaded", tt.name)
+		}
+
+		_, err = os.Stat(filepath.Join(wdir, "index.html"))
+		if deleted := os.IsNotExist(err); deleted != tt.wantDeleted {
+			t.Errorf("%s: file deleted = %v; want %v", tt.name, deleted, tt.wantDeleted)
+		}
+	}
+}
+
+func TestRulesFile(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "web")
+	mkdirs(t, wdir, "assets")
+	writeFile(t, wdir, "web/app.js", []byte("app"))
+	writeFile(t, wdir, "web/app.map", []byte("map"))
+	writeFile(t, wdir, "assets/lib.js", []byte("lib"))
+
+	rules := `[
+		{"source": "` + filepath.Join(wdir, "web") + `", "target": "bucket/site", "ignore": "*.map", "cache_control": "no-cache"},
+		{"source": "` + filepath.Join(wdir, "assets") + `", "target": "bucket/static", "acl": ["allUsers:READER"], "gzip": []}
+	]`
+	writeFile(t, wdir, "rules.json", []byte(rules))
+
+	p := Plugin{Config: Config{
+		RulesFile:    filepath.Join(wdir, "rules.json"),
+		Gzip:         []string{"js"},
+		CacheControl: "public,max-age=60",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if len(fake.objects) != 2 {
+		t.Errorf("%d objects uploaded; want 2", len(fake.objects))
+	}
+
+	site := fake.object("site/app.js")
+	if site == nil {
+		t.Fatal("site/app.js was not uploaded")
+	}
+	if site.attrs.ContentEncoding != "gzip" || site.attrs.CacheControl != "no-cache" || len(site.attrs.ACL) != 0 {
+		t.Errorf("site/app.js encoding %q, cache control %q, ACL %v; want gzip, no-cache and no ACL",
+			site.attrs.ContentEncoding, site.attrs.CacheControl, site.attrs.ACL)
+	}
+
+	static := fake.object("static/lib.js")
+	if static == nil {
+		t.Fatal("static/lib.js was not uploaded")
+	}
+	want := []storage.ACLRule{{Entity: "allUsers", Role: "READER"}}
+	if static.attrs.ContentEncoding != "" || static.attrs.CacheControl != "public,max-age=60" || !reflect.DeepEqual(static.attrs.ACL, want) {
+		t.Errorf("static/lib.js encoding %q, cache control %q, ACL %v; want no encoding, public,max-age=60 and %v",
+			static.attrs.ContentEncoding, static.attrs.CacheControl, static.attrs.ACL, want)
+	}
+
+	if p.summary.Uploaded != 2 {
+		t.Errorf("summary uploaded = %d; want 2", p.summary.Uploaded)
+	}
+}
+
+func TestInvalidRulesFile(t *testing.T) {
+	tests := map[string]string{
+		`{}`:                          "error parsing rules file",
+		`[]`:                          "rules file has no rules",
+		`[{"source": "s", "gz": []}]`: "unknown field",
+		`[{"acl": ["allUsers"]}]`:     "rule 1: invalid ACL",
+		`[{"ignore": "["}]`:           "rule 1: invalid pattern",
+		`[{"source": "s"}]`:           "rule 1: missing source or target",
+	}
+
+	for rules, want := range tests {
+		wdir := t.TempDir()
+		writeFile(t, wdir, "rules.json", []byte(rules))
+
+		p := Plugin{Config: Config{RulesFile: filepath.Join(wdir, "rules.json")}}
+		err := p.Exec(newFakeGCS().client(t))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("rules %s: Exec = %v; want error containing %q", rules, err, want)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "keep.txt", []byte("keep"))
+	writeFile(t, wdir, "skip.log", []byte("log"))
+
+	fake := newFakeGCS()
+	fake.put("site/keep.txt", []byte("old"))
+	fake.put("site/stale.txt", []byte("stale"))
+	fake.put("site/old/stale.css", []byte("stale"))
+	fake.put("site/server.log", []byte("ignored"))
+	fake.put("site-other/file.txt", []byte("other"))
+	fake.put("root.txt", []byte("root"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket/site",
+		Ignore: "*.log",
+		Sync:   true,
+	}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for name := range fake.objects {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"root.txt", "site-other/file.txt", "site/keep.txt", "site/server.log"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("objects = %v; want %v", got, want)
+	}
+	if b := string(fake.object("site/keep.txt").body); b != "keep" {
+		t.Errorf("site/keep.txt = %q; want keep", b)
+	}
+}
+
+func TestSyncCanonicalNames(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "caf\u00e9.txt", []byte("nfc"))
+	writeFile(t, wdir, "readme.txt", []byte("readme"))
+
+	fake := newFakeGCS()
+	fake.put("site/cafe\u0301.txt", []byte("nfd"))
+	fake.put("site/README.txt", []byte("upper"))
+	fake.put("site/stale.txt", []byte("stale"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source: wdir,
+			Target: "bucket/site",
+			Sync:   true,
+		},
+		printf: logs.printf,
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for name := range fake.objects {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"site/README.txt", "site/cafe\u0301.txt", "site/caf\u00e9.txt", "site/readme.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("objects = %q; want %q", got, want)
+	}
+	if warnings := logs.with("site/README.txt: not deleted"); len(warnings) != 1 {
+		t.Errorf("want a warning about site/README.txt, got logs %q", logs.lines)
+	}
+}
+
+func TestSyncEmptySource(t *testing.T) {
+	fake := newFakeGCS()
+	fake.put("site/file.txt", []byte("file"))
+
+	p := Plugin{Config: Config{
+		Source: t.TempDir(),
+		Target: "bucket/site",
+		Sync:   true,
+	}}
+	if err := p.Exec(fake.client(t)); err == nil {
+		t.Error("wanted error for an empty source")
+	}
+	if fake.object("site/file.txt") == nil {
+		t.Error("site/file.txt was deleted")
+	}
+}
+
+func TestEmptySource(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("js"))
+
+	p := Plugin{Config: Config{Source: wdir, Target: "bucket", Include: "*.css"}}
+	if err := p.Exec(newFakeGCS().client(t)); err == nil || !strings.Contains(err.Error(), "no files to upload") {
+		t.Errorf("err = %v; want no files to upload", err)
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("js"))
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"no matching file", wdir},
+		{"missing source", filepath.Join(wdir, "dist")},
+	}
+
+	for _, tt := range tests {
+		fake := newFakeGCS()
+		fake.put("site/file.txt", []byte("file"))
+
+		var logs, failures logLines
+		p := Plugin{
+			Config: Config{
+				Source:     tt.source,
+				Target:     "bucket/site",
+				Include:    "*.css",
+				Sync:       true,
+				AllowEmpty: true,
+			},
+			printf: logs.printf,
+			fatalf: failures.printf,
+		}
+		if err := p.Exec(fake.client(t)); err != nil || len(failures.lines) != 0 {
+			t.Fatalf("%s: Exec = %v, fatal %q", tt.name, err, failures.lines)
+		}
+
+		if lines := logs.with("nothing to upload"); len(lines) != 1 {
+			t.Errorf("%s: logged %q; want nothing to upload", tt.name, logs.lines)
+		}
+		if fake.object("site/file.txt") == nil {
+			t.Errorf("%s: site/file.txt was deleted", tt.name)
+		}
+	}
+}
+
+// logLines collects the lines logged by a Plugin.
+type logLines struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logLines) printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// with returns the logged lines starting with prefix.
+func (l *logLines) with(prefix string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestProgress(t *testing.T) {
+	wdir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256*1024) // 4 MB
+	writeFile(t, wdir, "large.bin", content)
+	writeFile(t, wdir, "small.txt", []byte("text"))
+
+	var logs logLines
+	fake := newFakeGCS()
+	p := Plugin{
+		Config: Config{Source: wdir, Target: "bucket/dir", Progress: true},
+		printf: logs.printf,
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := logs.with("dir/large.bin: "); len(got) != 1 || !strings.HasPrefix(got[0], "dir/large.bin: 4194304 bytes uploaded, ") {
+		t.Errorf("large.bin progress = %q; want 4194304 bytes uploaded", got)
+	}
+
+	total := logs.with("progress: ")
+	if len(total) != 1 || !strings.HasPrefix(total[0], fmt.Sprintf("progress: %d bytes uploaded in ", len(content)+4)) {
+		t.Errorf("total progress = %q; want %d bytes uploaded", total, len(content)+4)
+	}
+}
+
+func TestProgressRetry(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	// the first attempt fails once its content is read
+	fake := newFakeGCS()
+	fake.uploadErrors = []int{http.StatusServiceUnavailable}
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:               wdir,
+			Target:               "bucket",
+			Progress:             true,
+			Retries:              1,
+			DisableClientRetries: true,
+		},
+		printf: logs.printf,
+		sleep:  func(time.Duration) {},
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if total := logs.with("progress: "); len(total) != 1 || !strings.HasPrefix(total[0], "progress: 4 bytes uploaded in ") {
+		t.Errorf("total progress = %q; want the 4 bytes of the file counted once", total)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+	writeFile(t, wdir, "index.html", []byte("html"))
+
+	fake := newFakeGCS()
+	fake.put("site/stale.txt", []byte("stale"))
+
+	var log logLines
+	p := Plugin{
+		Config: Config{
+			Source: wdir,
+			Target: "bucket/site",
+			Gzip:   []string{"js"},
+			Sync:   true,
+			DryRun: true,
+		},
+		printf: log.printf,
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"DRY-RUN delete gs://bucket/site/stale.txt",
+		"DRY-RUN upload gs://bucket/site/app.js content-type=text/javascript; charset=utf-8 compression=gzip",
+		"DRY-RUN upload gs://bucket/site/index.html content-type=text/html; charset=utf-8 compression=none",
+	}
+	if got := log.with("DRY-RUN"); !reflect.DeepEqual(got, want) {
+		t.Errorf("dry-run log = %q; want %q", got, want)
+	}
+	if len(fake.objects) != 1 || fake.object("site/stale.txt") == nil {
+		t.Errorf("bucket was modified during a dry run")
+	}
+}
+
+func TestContentTypeMap(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.wasm", []byte("wasm"))
+	writeFile(t, wdir, "APP.MAP", []byte("{}"))
+	writeFile(t, wdir, "index.html", []byte("html"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket",
+		ContentTypeMap: map[string]string{
+			".WASM": "application/wasm",
+			"map":   "application/json",
+		},
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"app.wasm":   "application/wasm",
+		"APP.MAP":    "application/json",
+		"index.html": "text/html; charset=utf-8",
+	} {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if obj.attrs.ContentType != want {
+			t.Errorf("%s: ContentType = %q; want %q", name, obj.attrs.ContentType, want)
+		}
+	}
+}
+
+func TestDownloadRetryNotFound(t *testing.T) {
+	tests := []struct {
+		retries int
+		wantErr bool
+	}{
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+
+	for _, tc := range tests {
+		wdir := t.TempDir()
+		fake := newFakeGCS()
+		fake.put("dir/file.txt", []byte("text"))
+		fake.notFound = map[string]int{"dir/file.txt": 2}
+
+		var sleeps []time.Duration
+		p := Plugin{
+			Config: Config{
+				Source:          "bucket/dir",
+				Target:          wdir,
+				Download:        true,
+				DownloadRetries: tc.retries,
+			},
+			sleep: func(d time.Duration) { sleeps = append(sleeps, d) },
+		}
+		err := p.Exec(fake.client(t))
+
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("%d retries: wanted error", tc.retries)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%d retries: %v", tc.retries, err)
+		case !tc.wantErr:
+			b, err := os.ReadFile(filepath.Join(wdir, "dir", "file.txt"))
+			if err != nil || string(b) != "text" {
+				t.Errorf("%d retries: file = %q, %v; want text", tc.retries, b, err)
+			}
+		}
+		if len(sleeps) != tc.retries {
+			t.Errorf("%d retries: slept %d times", tc.retries, len(sleeps))
+		}
+	}
+}
+
+func TestEncodingMap(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js.br", []byte("brotli bytes"))
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+
+	p := Plugin{Config: Config{
+		Source:      wdir,
+		Target:      "bucket",
+		Gzip:        []string{"br", "js"},
+		EncodingMap: map[string]string{".br": "br"},
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := fake.object("app.js.br")
+	if br == nil {
+		t.Fatal("app.js.br was not uploaded")
+	}
+	if br.attrs.ContentEncoding != "br" {
+		t.Errorf("app.js.br: ContentEncoding = %q; want br", br.attrs.ContentEncoding)
+	}
+	if !strings.HasPrefix(br.attrs.ContentType, "text/javascript") {
+		t.Errorf("app.js.br: ContentType = %q; want text/javascript", br.attrs.ContentType)
+	}
+	if string(br.body) != "brotli bytes" {
+		t.Errorf("app.js.br: body = %q; want it uploaded verbatim", br.body)
+	}
+
+	js := fake.object("app.js")
+	if js == nil {
+		t.Fatal("app.js was not uploaded")
+	}
+	if js.attrs.ContentEncoding != "gzip" {
+		t.Errorf("app.js: ContentEncoding = %q; want gzip", js.attrs.ContentEncoding)
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "same.txt", []byte("same"))
+	writeFile(t, wdir, "same.js", []byte("javascript"))
+	writeFile(t, wdir, "changed.txt", []byte("new"))
+	writeFile(t, wdir, "added.txt", []byte("added"))
+
+	// seed the bucket with a first upload
+	fake := newFakeGCS()
+	p := Plugin{Config: Config{Source: wdir, Target: "bucket", Gzip: []string{"js"}}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	fake.put("changed.txt", []byte("old"))
+	delete(fake.objects, "added.txt")
+
+	var log logLines
+	p = Plugin{
+		Config: Config{Source: wdir, Target: "bucket", Gzip: []string{"js"}, SkipUnchanged: true},
+		printf: log.printf,
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"same.js: skipped, object is unchanged", "same.txt: skipped, object is unchanged"}
+	if got := log.with("same"); !reflect.DeepEqual(got, want) {
+		t.Errorf("log = %q; want %q", got, want)
+	}
+	if b := string(fake.object("changed.txt").body); b != "new" {
+		t.Errorf("changed.txt = %q; want new", b)
+	}
+	if fake.object("added.txt") == nil {
+		t.Errorf("added.txt was not uploaded")
+	}
+}
+
+func TestVerifyDownloadCount(t *testing.T) {
+	wdir := t.TempDir()
+	fake := newFakeGCS()
+	fake.put("dir/", nil)
+	fake.put("dir/a.txt", []byte("a"))
+	fake.put("dir/b.txt", []byte("b"))
+	fake.put("dir/c.txt", []byte("c"))
+	fake.notFound = map[string]int{"dir/b.txt": 1}
+
+	var log logLines
+	p := Plugin{
+		Config: Config{
+			Source:              "bucket/dir/",
+			Target:              wdir,
+			Download:            true,
+			VerifyDownloadCount: true,
+		},
+		printf: log.printf,
+	}
+	err := p.Exec(fake.client(t))
+
+	want := "downloaded 2 of 3 objects (4 listed, 1 filtered)"
+	if err == nil || err.Error() != want {
+		t.Errorf("Exec = %v; want %q", err, want)
+	}
+	if len(log.with("dir/b.txt")) != 1 {
+		t.Errorf("failed object was not logged: %q", log.lines)
+	}
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if _, err := os.Stat(filepath.Join(wdir, "dir", name)); err != nil {
+			t.Errorf("%s was not downloaded: %v", name, err)
+		}
+	}
+}
+
+func TestDedupeCollisions(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "web")
+	writeFile(t, wdir, "app.js", []byte("same"))
+	writeFile(t, wdir, "web/app.js", []byte("same"))
+	writeFile(t, wdir, "site.css", []byte("root style"))
+	writeFile(t, wdir, "web/site.css", []byte("web style"))
+
+	p := Plugin{Config: Config{
+		Source:             wdir,
+		Target:             "bucket",
+		TrimPrefix:         "web/",
+		TrimPrefixOptional: true,
+		DedupeCollisions:   true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := fileHash(filepath.Join(wdir, "web", "site.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"app.js":                   "same",
+		"site.css":                 "root style",
+		"site-" + sum[:8] + ".css": "web style",
+	}
+	if len(fake.objects) != len(want) {
+		t.Errorf("uploaded %d objects; want %d", len(fake.objects), len(want))
+	}
+	for name, body := range want {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if string(obj.body) != body {
+			t.Errorf("%s = %q; want %q", name, obj.body, body)
+		}
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+	writeFile(t, wdir, "site.css", []byte("style"))
+
+	var log logLines
+	p := Plugin{
+		Config: Config{
+			Source: wdir,
+			Target: "bucket",
+			Gzip:   []string{"css", "js"},
+			Brotli: []string{"js"},
+		},
+		printf: log.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log.with("warning: js")) != 1 {
+		t.Errorf("no warning logged for js in both lists: %q", log.lines)
+	}
+
+	js := fake.object("app.js")
+	if js == nil {
+		t.Fatal("app.js was not uploaded")
+	}
+	if js.attrs.ContentEncoding != "br" {
+		t.Errorf("app.js: ContentEncoding = %q; want br", js.attrs.ContentEncoding)
+	}
+	b, err := io.ReadAll(brotli.NewReader(bytes.NewReader(js.body)))
+	if err != nil || string(b) != "javascript" {
+		t.Errorf("app.js: brotli body = %q, %v; want javascript", b, err)
+	}
+
+	css := fake.object("site.css")
+	if css == nil {
+		t.Fatal("site.css was not uploaded")
+	}
+	if css.attrs.ContentEncoding != "gzip" {
+		t.Errorf("site.css: ContentEncoding = %q; want gzip", css.attrs.ContentEncoding)
+	}
+}
+
+func TestParseACLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		want    []storage.ACLRule
+		wantErr string
+	}{
+		{"empty", nil, nil, ""},
+		{
+			"merged",
+			[]string{
+				"user-b@example.com:READER",
+				"allUsers:READER",
+				"group-a@example.com:OWNER",
+				"user-b@example.com:OWNER",
+				"allUsers:READER",
+			},
+			[]storage.ACLRule{
+				{Entity: "allUsers", Role: "READER"},
+				{Entity: "group-a@example.com", Role: "OWNER"},
+				{Entity: "user-b@example.com", Role: "OWNER"},
+			},
+			"",
+		},
+		{
+			"malformed",
+			[]string{"allUsers", "allUsers:reader", "project-viewers-123:READER", "b@example.com:OWNER"},
+			nil,
+			`invalid ACL "allUsers" (want entity:role), "allUsers:reader" (unknown role reader, want READER, WRITER or OWNER), "b@example.com:OWNER" (unknown entity b@example.com)`,
+		},
+	}
+
+	for _, tt := range tests {
+		acl, err := parseACLs(tt.rules)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: err = %v; want %s", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(acl, tt.want) {
+			t.Errorf("%s: parseACLs = %v; want %v", tt.name, acl, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.tar.gz", []byte("app"))
+	mkdirs(t, filepath.Join(wdir, "bin"))
+	writeFile(t, wdir, "bin/tool", []byte("tool"))
+
+	p := Plugin{Config: Config{
+		Source:             wdir,
+		Target:             "bucket/release",
+		ContentDisposition: `attachment; filename="{filename}"`,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"release/app.tar.gz": `attachment; filename="app.tar.gz"`,
+		"release/bin/tool":   `attachment; filename="tool"`,
+	} {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Fatalf("%s was not uploaded", name)
+		}
+		if obj.attrs.ContentDisposition != want {
+			t.Errorf("%s: ContentDisposition = %q; want %q", name, obj.attrs.ContentDisposition, want)
+		}
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "index.html", []byte("<p>bonjour</p>"))
+
+	p := Plugin{Config: Config{
+		Source:          wdir,
+		Target:          "bucket/fr",
+		ContentLanguage: "fr-CA",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("fr/index.html")
+	if obj == nil {
+		t.Fatal("fr/index.html was not uploaded")
+	}
+	if obj.attrs.ContentLanguage != "fr-CA" {
+		t.Errorf("ContentLanguage = %q; want fr-CA", obj.attrs.ContentLanguage)
+	}
+
+	for tag, want := range map[string]bool{"en": true, "zh-Hant-TW": true, "es-419": true, "e": false, "en_US": false, "en-": false} {
+		if got := validLanguageTag(tag); got != want {
+			t.Errorf("validLanguageTag(%q) = %v; want %v", tag, got, want)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:      wdir,
+			Target:      "bucket/dir",
+			Token:       "secret-token",
+			OidcIdToken: "secret-oidc",
+			WebhookURL:  hook.URL + "/services/secret-hook",
+			PrintConfig: true,
+		},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := logs.with("effective config: ")
+	if len(lines) != 1 {
+		t.Fatalf("logged config %q; want one line", lines)
+	}
+	for _, s := range []string{"Target:bucket/dir", "Token:[redacted]", "OidcIdToken:[redacted]", "WebhookURL:[redacted]"} {
+		if !strings.Contains(lines[0], s) {
+			t.Errorf("config %q does not contain %q", lines[0], s)
+		}
+	}
+	for _, s := range []string{"secret-token", "secret-oidc", "secret-hook"} {
+		if strings.Contains(lines[0], s) {
+			t.Errorf("config %q leaks %q", lines[0], s)
+		}
+	}
+	if p.Config.Token != "secret-token" {
+		t.Errorf("Token = %q; want it unchanged", p.Config.Token)
+	}
+}
+
+func TestMetadataSize(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket",
+		Metadata: map[string]string{
+			"changelog": strings.Repeat("x", 8*1024),
+			"commit":    "abc123",
+		},
+	}}
+
+	fake := newFakeGCS()
+	err := p.Exec(fake.client(t))
+	if err == nil {
+		t.Fatal("expected oversized metadata to fail")
+	}
+	want := "metadata is 8213 bytes, over the 8192 bytes limit: changelog (8201 bytes), commit (12 bytes)"
+	if err.Error() != want {
+		t.Errorf("err = %q; want %q", err, want)
+	}
+	if fake.object("file.txt") != nil {
+		t.Error("file.txt was uploaded")
+	}
+
+	p.Config.Metadata = map[string]string{"commit": "abc123"}
+	p.Config.GzipMetadata = map[string]string{"gzip": strings.Repeat("x", 8*1024)}
+	if err := p.Exec(fake.client(t)); err == nil || !strings.HasPrefix(err.Error(), "gzip metadata: ") {
+		t.Errorf("err = %v; want a gzip metadata error", err)
+	}
+}
+
+func TestRetryUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		errors  []int
+		retries int
+		wantErr bool
+		sleeps  []time.Duration
+	}{
+		{"first attempt", nil, 3, false, nil},
+		{"third attempt", []int{503, 429}, 3, false, []time.Duration{time.Second, 2 * time.Second}},
+		{"exhausted", []int{500, 500, 500}, 2, true, []time.Duration{time.Second, 2 * time.Second}},
+		{"not found", []int{404, 503}, 3, true, nil},
+		{"forbidden", []int{403}, 3, true, nil},
+		{"no retries", []int{503}, 0, true, nil},
+	}
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGCS()
+			fake.uploadErrors = tt.errors
+
+			var (
+				logs   logLines
+				sleeps []time.Duration
+			)
+			p := Plugin{
+				Config: Config{Retries: tt.retries, RetryBackoff: time.Second},
+				bucket: fake.client(t).Bucket("bucket"),
+				printf: logs.printf,
+				sleep:  func(d time.Duration) { sleeps = append(sleeps, d) },
+			}
+
+			err := p.retryUpload("file.txt", filepath.Join(wdir, "file.txt"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retryUpload error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if uploaded := fake.object("file.txt") != nil; uploaded == tt.wantErr {
+				t.Errorf("uploaded = %v; want %v", uploaded, !tt.wantErr)
+			}
+			if !reflect.DeepEqual(sleeps, tt.sleeps) {
+				t.Errorf("sleeps = %v; want %v", sleeps, tt.sleeps)
+			}
+			if n := len(logs.with("file.txt: attempt ")); n != len(tt.sleeps) {
+				t.Errorf("logged %d retries; want %d", n, len(tt.sleeps))
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	fake := newFakeGCS()
+	fake.uploadErrors = []int{http.StatusTooManyRequests}
+	fake.retryAfter = "2"
+
+	var sleeps []time.Duration
+	p := Plugin{
+		Config: Config{Retries: 3, RetryBackoff: 100 * time.Millisecond},
+		bucket: fake.client(t).Bucket("bucket"),
+		printf: func(string, ...interface{}) {},
+		sleep:  func(d time.Duration) { sleeps = append(sleeps, d) },
+	}
+
+	if err := p.retryUpload("file.txt", filepath.Join(wdir, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("file.txt") == nil {
+		t.Error("file.txt not uploaded")
+	}
+	if want := []time.Duration{2 * time.Second}; !reflect.DeepEqual(sleeps, want) {
+		t.Errorf("sleeps = %v; want %v", sleeps, want)
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	// the transport hangs until the request is canceled
+	hc := &http.Client{Transport: &fakeTransport{func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Plugin{
+		Config: Config{Timeout: 50 * time.Millisecond},
+		bucket: client.Bucket("bucket"),
+	}
+
+	file := filepath.Join(wdir, "file.txt")
+	done := make(chan error, 1)
+	go func() { done <- p.uploadFile("file.txt", file) }()
+
+	select {
+	case err := <-done:
+		want := "upload of " + file + " timed out after "
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("err = %v; want it to start with %q", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload was not canceled")
+	}
+}
+
+func TestDownloadBundle(t *testing.T) {
+	tests := []struct {
+		strip bool
+		want  map[string]string
+	}{
+		{false, map[string]string{"dir/js/app.js": "javascript", "dir/css/site.css": "style"}},
+		{true, map[string]string{"js/app.js": "javascript", "css/site.css": "style"}},
+	}
+
+	for _, tc := range tests {
+		fake := newFakeGCS()
+		fake.put("dir/js/app.js", []byte("javascript"))
+		fake.put("dir/css/site.css", []byte("style"))
+		fake.put("other/file.txt", []byte("other"))
+
+		target := filepath.Join(t.TempDir(), "out", "bundle.tar.gz")
+		p := Plugin{Config: Config{
+			Source:              "bucket/dir",
+			Target:              target,
+			Download:            true,
+			DownloadBundle:      true,
+			DownloadBundleStrip: tc.strip,
+		}}
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("strip %v: %v", tc.strip, err)
+		}
+
+		b, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]string)
+		tr := tar.NewReader(bytes.NewReader(gunzip(t, b)))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[hdr.Name] = string(content)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("strip %v: bundle = %v; want %v", tc.strip, got, tc.want)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "index.html", []byte("html"))
+	writeFile(t, filepath.Join(wdir, "js"), "app.js", []byte("javascript"))
+
+	want := map[string]string{"index.html": "html", "js/app.js": "javascript"}
+
+	for _, format := range []string{archiveTarGz, archiveZip} {
+		fake := newFakeGCS()
+		p := Plugin{Config: Config{
+			Source:  wdir,
+			Target:  "bucket/release/site." + format,
+			Archive: format,
+		}}
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		if len(fake.objects) != 1 {
+			t.Errorf("%s: %d objects uploaded; want 1", format, len(fake.objects))
+		}
+		obj := fake.object("release/site." + format)
+		if obj == nil {
+			t.Fatalf("%s: archive not uploaded", format)
+		}
+		if obj.attrs.ContentType != archiveContentTypes[format] {
+			t.Errorf("%s: content type = %q; want %q", format, obj.attrs.ContentType, archiveContentTypes[format])
+		}
+
+		got := make(map[string]string)
+		if format == archiveZip {
+			zr, err := zip.NewReader(bytes.NewReader(obj.body), int64(len(obj.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(r)
+				r.Close()
+				got[f.Name] = string(content)
+			}
+		} else {
+			tr := tar.NewReader(bytes.NewReader(gunzip(t, obj.body)))
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(tr)
+				got[hdr.Name] = string(content)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: archive = %v; want %v", format, got, want)
+		}
+	}
+}
+
+func TestArchiveEntryError(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "index.html", []byte("html"))
+
+	// the second file vanished since the walk
+	src := []string{filepath.Join(wdir, "index.html"), filepath.Join(wdir, "gone.js")}
+
+	for _, format := range []string{archiveTarGz, archiveZip} {
+		fake := newFakeGCS()
+		p := Plugin{Config: Config{
+			Source:  wdir,
+			Target:  "release/site." + format,
+			Archive: format,
+		}}
+		p.bucket = fake.client(t).Bucket("bucket")
+
+		if err := p.execArchive(src); err == nil {
+			t.Errorf("%s: expected the missing file to fail the archive", format)
+		}
+		if obj := fake.object("release/site." + format); obj != nil {
+			t.Errorf("%s: truncated archive of %d bytes uploaded", format, len(obj.body))
+		}
+	}
+}
+
+func TestOrderedLog(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "b")
+	writeFile(t, wdir, "100%done.txt", []byte("done"))
+	writeFile(t, wdir, "a.txt", []byte("a"))
+	writeFile(t, wdir, "b/c.txt", []byte("c"))
+
+	for _, ordered := range []bool{false, true} {
+		var logs logLines
+		p := Plugin{
+			Config: Config{
+				Source:     wdir,
+				Target:     "bucket",
+				OrderedLog: ordered,
+			},
+			printf: logs.printf,
+		}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"100%done.txt", "a.txt", "b/c.txt"}
+		got := logs.lines
+		if !ordered {
+			got = logs.with("")
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ordered %v: logged %q; want %q", ordered, got, want)
+		}
+	}
+}
+
+func TestSortedSummary(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "b")
+	for _, name := range []string{"c.txt", "a.txt", "b/d.txt", "b/a.txt"} {
+		writeFile(t, wdir, name, []byte(name))
+	}
+
+	var logs logLines
+	fake := newFakeGCS()
+	fake.block = make(chan struct{})
+	fake.uploadErrors = []int{http.StatusForbidden}
+	p := Plugin{
+		Config: Config{
+			Source:          wdir,
+			Target:          "bucket/dir",
+			SortedSummary:   true,
+			ContinueOnError: true,
+		},
+		printf: logs.printf,
+	}
+
+	// the uploads complete in any order once released together
+	time.AfterFunc(50*time.Millisecond, func() { close(fake.block) })
+	if err := p.Exec(fake.client(t)); err == nil {
+		t.Fatal("expected the failed upload to fail the run")
+	}
+
+	var got []string
+	for _, line := range logs.lines {
+		if f := strings.Fields(line); len(f) > 1 && (f[0] == "ok" || f[0] == "failed") {
+			got = append(got, strings.TrimSuffix(f[1], ":"))
+		}
+	}
+	want := []string{"dir/a.txt", "dir/b/a.txt", "dir/b/d.txt", "dir/c.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %q; want %q", got, want)
+	}
+	if n := len(logs.with("failed ")); n != 1 {
+		t.Errorf("%d failed files listed; want 1", n)
+	}
+	if last := logs.lines[len(logs.lines)-1]; last != "3 uploaded, 0 skipped, 1 failed" {
+		t.Errorf("last line = %q; want the counts", last)
+	}
+}
+
+func TestSortedSummaryDetails(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "b.txt", []byte("b"))
+	writeFile(t, wdir, "a.txt", []byte("a"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:        wdir,
+			Target:        "bucket/dir",
+			SortedSummary: true,
+			PublicURL:     true,
+			LogDurations:  true,
+		},
+		printf: logs.printf,
+	}
+
+	if err := p.Exec(newFakeGCS().client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lines of each file follow its status line
+	var got []string
+	for _, line := range logs.lines {
+		if strings.HasPrefix(line, "ok ") {
+			got = append(got, strings.Join(strings.Fields(line), " "))
+		}
+		if i := strings.Index(line, ": uploaded in "); i > 0 {
+			got = append(got, line[:i]+": uploaded")
+		}
+		if strings.Contains(line, ": https://") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"ok dir/a.txt",
+		"a.txt: https://storage.googleapis.com/bucket/dir/a.txt",
+		"a.txt: uploaded",
+		"ok dir/b.txt",
+		"b.txt: https://storage.googleapis.com/bucket/dir/b.txt",
+		"b.txt: uploaded",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %q; want %q", got, want)
+	}
+}
+
+func TestCompressConcurrency(t *testing.T) {
+	wdir := t.TempDir()
+	p := Plugin{Config: Config{Gzip: []string{"js"}}}
+	p.compressSlots = make(chan struct{}, 2)
+
+	// the readers are not consumed yet, so the compressions holding
+	// a slot block on the pipe and the others wait for a slot
+	var readers []io.ReadCloser
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("file%d.js", i)
+		writeFile(t, wdir, name, []byte(name))
+		r, enc, err := p.compressor(filepath.Join(wdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc != encodingGzip {
+			t.Fatalf("%s: encoding = %q; want gzip", name, enc)
+		}
+		readers = append(readers, r)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.compressSlots) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(p.compressSlots); n != 2 {
+		t.Fatalf("%d files compressed at once; want 2", n)
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([][]byte, len(readers))
+	for i, r := range readers {
+		wg.Add(1)
+		go func(i int, r io.ReadCloser) {
+			defer wg.Done()
+			defer r.Close()
+			bodies[i], _ = io.ReadAll(r)
+		}(i, r)
+	}
+	wg.Wait()
+
+	for i, b := range bodies {
+		if got, want := string(gunzip(t, b)), fmt.Sprintf("file%d.js", i); got != want {
+			t.Errorf("file %d: content = %q; want %q", i, got, want)
+		}
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(p.compressSlots) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(p.compressSlots); n != 0 {
+		t.Errorf("%d compression slots still held", n)
+	}
+}
+
+func TestCustomTime(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "report.csv", []byte("report"))
+
+	customTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	p := Plugin{Config: Config{
+		Source:     wdir,
+		Target:     "bucket",
+		CustomTime: customTime,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if got := fake.object("report.csv").attrs.CustomTime; !got.Equal(customTime) {
+		t.Errorf("object custom time = %v; want %v", got, customTime)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "audit.log", []byte("audit"))
+
+	for _, hold := range []bool{false, true} {
+		p := Plugin{Config: Config{
+			Source:         wdir,
+			Target:         "bucket",
+			TemporaryHold:  hold,
+			EventBasedHold: hold,
+		}}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		attrs := fake.object("audit.log").attrs
+		if attrs.TemporaryHold != hold || attrs.EventBasedHold != hold {
+			t.Errorf("holds %v: object temporary hold %v, event-based hold %v",
+				hold, attrs.TemporaryHold, attrs.EventBasedHold)
+		}
+	}
+}
+
+func TestPredefinedACL(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	p := Plugin{Config: Config{
+		Source:        wdir,
+		Target:        "bucket",
+		PredefinedACL: "publicRead",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("file.txt")
+	if obj == nil {
+		t.Fatal("file.txt was not uploaded")
+	}
+	if obj.attrs.PredefinedACL != "publicRead" {
+		t.Errorf("PredefinedACL = %q; want publicRead", obj.attrs.PredefinedACL)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		payloads []map[string]interface{}
+		status   = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q; want application/json", ct)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		payloads = append(payloads, payload)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "a.txt", []byte("hello"))
+	writeFile(t, wdir, "b.txt", []byte("world!"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:     wdir,
+			Target:     "bucket/dir",
+			WebhookURL: srv.URL,
+		},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payloads) != 1 {
+		t.Fatalf("webhook called %d times; want 1", len(payloads))
+	}
+	got := payloads[0]
+	if d, ok := got["duration_seconds"].(float64); !ok || d < 0 {
+		t.Errorf("duration_seconds = %v; want a positive number", got["duration_seconds"])
+	}
+	delete(got, "duration_seconds")
+	want := map[string]interface{}{
+		"target":   "bucket/dir",
+		"status":   "success",
+		"uploaded": float64(2),
+		"skipped":  float64(0),
+		"failed":   float64(0),
+		"bytes":    float64(11),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload = %v; want %v", got, want)
+	}
+
+	// a failed run is reported too
+	p = Plugin{
+		Config: Config{Source: wdir, Target: "bucket", Ignore: "[", WebhookURL: srv.URL},
+		printf: logs.printf,
+	}
+	if err := p.Exec(fake.client(t)); err == nil {
+		t.Fatal("expected an invalid ignore pattern to fail")
+	}
+	if len(payloads) != 2 || payloads[1]["status"] != "failure" || payloads[1]["error"] == "" {
+		t.Errorf("payloads = %v; want a failure", payloads)
+	}
+
+	// webhook failures are only logged unless required
+	status = http.StatusInternalServerError
+	p = Plugin{
+		Config: Config{Source: wdir, Target: "bucket", WebhookURL: srv.URL},
+		printf: logs.printf,
+	}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Errorf("Exec with a failing webhook: %v", err)
+	}
+	if lines := logs.with("webhook: "); len(lines) != 1 {
+		t.Errorf("logged %q; want one webhook error", lines)
+	}
+
+	p.Config.WebhookRequired = true
+	if err := p.Exec(fake.client(t)); err == nil {
+		t.Error("expected a required webhook failure to fail the run")
+	}
+}
+
+func TestACLSidecars(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "public", "sub")
+	writeFile(t, wdir, "private.txt", []byte("private"))
+	writeFile(t, wdir, "public/.acl", []byte("# world readable\nallUsers:READER\n"))
+	writeFile(t, wdir, "public/a.txt", []byte("a"))
+	writeFile(t, wdir, "public/sub/b.txt", []byte("b"))
+	writeFile(t, wdir, "public/sub/c.txt", []byte("c"))
+	writeFile(t, wdir, "public/sub/c.txt.acl", []byte("user-c@example.com:READER\nuser-admin@example.com:WRITER\n"))
+
+	p := Plugin{Config: Config{
+		Source:      wdir,
+		Target:      "bucket",
+		ACL:         []string{"user-admin@example.com:OWNER"},
+		ACLSidecars: true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := storage.ACLRule{Entity: "user-admin@example.com", Role: "OWNER"}
+	public := storage.ACLRule{Entity: "allUsers", Role: "READER"}
+	tests := map[string][]storage.ACLRule{
+		"private.txt":      {admin},
+		"public/a.txt":     {public, admin},
+		"public/sub/b.txt": {public, admin},
+		"public/sub/c.txt": {
+			{Entity: "user-admin@example.com", Role: "WRITER"},
+			{Entity: "user-c@example.com", Role: "READER"},
+		},
+	}
+	for name, want := range tests {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if !reflect.DeepEqual(obj.attrs.ACL, want) {
+			t.Errorf("%s: ACL = %v; want %v", name, obj.attrs.ACL, want)
+		}
+	}
+	if n := len(fake.objects); n != len(tests) {
+		t.Errorf("uploaded %d objects; want %d, without the sidecars", n, len(tests))
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	wdir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		writeFile(t, wdir, fmt.Sprintf("file%02d.txt", i), []byte("text"))
+	}
+
+	// with a single retry per file every retry waits for one second
+	tests := []struct {
+		name    string
+		perFile int
+		retries int
+		wait    time.Duration
+		want    int
+	}{
+		{"count", 5, 7, 0, 7},
+		{"duration", 1, 0, 5 * time.Second, 5},
+		{"both", 1, 3, 5 * time.Second, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGCS()
+			for i := 0; i < 100; i++ {
+				fake.uploadErrors = append(fake.uploadErrors, http.StatusServiceUnavailable)
+			}
+
+			var logs, failures logLines
+			p := Plugin{
+				Config: Config{
+					Source:              wdir,
+					Target:              "bucket",
+					Concurrency:         8,
+					Retries:             tt.perFile,
+					RetryBackoff:        time.Second,
+					RetryBudget:         tt.retries,
+					RetryBudgetDuration: tt.wait,
+				},
+				printf: logs.printf,
+				fatalf: failures.printf,
+				sleep:  func(time.Duration) {},
+			}
+
+			if err := p.Exec(fake.client(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			var retries int
+			for _, line := range logs.with("file") {
+				if strings.Contains(line, "retrying in") {
+					retries++
+				}
+			}
+			if retries != tt.want {
+				t.Errorf("retried %d times; want %d", retries, tt.want)
+			}
+			if n := len(failures.with("file")); n != 20 {
+				t.Errorf("%d uploads failed; want 20", n)
+			}
+		})
+	}
+}
+
+func TestPreserveMtime(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		wdir := t.TempDir()
+
+		fake := newFakeGCS()
+		obj := fake.put("dir/file.txt", []byte("content"))
+
+		p := Plugin{Config: Config{
+			Source:        "bucket/dir",
+			Target:        wdir,
+			Download:      true,
+			PreserveMtime: preserve,
+		}}
+
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		fi, err := os.Stat(filepath.Join(wdir, "dir", "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fi.ModTime().Equal(obj.attrs.Updated); got != preserve {
+			t.Errorf("PreserveMtime %v: mtime %v, object updated %v", preserve, fi.ModTime(), obj.attrs.Updated)
+		}
+	}
+}
+
+func TestDownloadFilter(t *testing.T) {
+	fake := newFakeGCS()
+	fake.put("dir/app.tar.gz", []byte("app"))
+	fake.put("dir/old/lib.tar.gz", []byte("lib"))
+	fake.put("dir/notes.txt", []byte("notes"))
+	fake.put("dir/app.tar", []byte("tar"))
+
+	wdir := t.TempDir()
+	p := Plugin{Config: Config{
+		Source:         "bucket/dir",
+		Target:         wdir,
+		Download:       true,
+		DownloadFilter: "*.tar.gz,old/**/*.tar.gz",
+	}}
+
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	var got []string
+	filepath.Walk(wdir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(wdir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return err
+	})
+
+	want := []string{"dir/app.tar.gz", "dir/old/lib.tar.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("downloaded %v; want %v", got, want)
+	}
+}
+
+func TestDownloadGeneration(t *testing.T) {
+	fake := newFakeGCS()
+	fake.put("dir/app.tar", []byte("current"))
+	fake.put("dir/app.tar.sig", []byte("signature"))
+	fake.generations = map[string]map[int64][]byte{
+		"dir/app.tar": {1: []byte("first"), 2: []byte("second")},
+	}
+
+	tests := []struct {
+		source     string
+		generation int64
+		want       string
+		wantErr    string
+	}{
+		{"bucket/dir/app.tar", 1, "first", ""},
+		{"bucket/dir/app.tar", 2, "second", ""},
+		{"bucket/dir/app.tar", 3, "", "generation 3 of dir/app.tar"},
+		{"bucket/dir/app", 1, "", "matches 2 objects, want a single object"},
+	}
+
+	for _, tt := range tests {
+		wdir := t.TempDir()
+		p := Plugin{Config: Config{
+			Source:     tt.source,
+			Target:     wdir,
+			Download:   true,
+			Generation: tt.generation,
+		}}
+
+		err := p.Exec(fake.client(t))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s#%d: Exec = %v; want error containing %q", tt.source, tt.generation, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s#%d: Exec: %v", tt.source, tt.generation, err)
+		}
+
+		b, err := os.ReadFile(filepath.Join(wdir, "dir", "app.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s#%d: downloaded %q; want %q", tt.source, tt.generation, b, tt.want)
+		}
+	}
+}
+
+func TestDownloadStdout(t *testing.T) {
+	fake := newFakeGCS()
+	fake.put("dir/report.json", []byte(`{"ok": true}`))
+	fake.put("dir/other.json", []byte(`{}`))
+
+	var stdout bytes.Buffer
+	p := Plugin{
+		Config: Config{
+			Source:   "bucket/dir/report.json",
+			Target:   "-",
+			Download: true,
+		},
+		stdout: &stdout,
+	}
+
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := stdout.String(); got != `{"ok": true}` {
+		t.Errorf("stdout = %q; want the object content", got)
+	}
+
+	p.Config.Source = "bucket/dir/"
+	err := p.Exec(fake.client(t))
+	if err == nil || !strings.Contains(err.Error(), "source dir/ matches 2 objects, want a single object") {
+		t.Errorf("Exec with a prefix = %v; want a single object error", err)
+	}
+}
+
+func TestDownloadExisting(t *testing.T) {
+	tests := []struct {
+		policy  string
+		compare bool
+		local   string
+		wantErr bool
+		want    string
+	}{
+		{downloadOverwrite, false, "old", false, "new content"},
+		{downloadSkip, false, "old", false, "old"},
+		{downloadFail, false, "old", true, "old"},
+		{downloadSkip, true, "old", false, "new content"},
+		{downloadSkip, true, "new contenX", false, "new contenX"},
+		{downloadFail, true, "old", false, "new content"},
+	}
+
+	for _, tt := range tests {
+		wdir := t.TempDir()
+		mkdirs(t, wdir, "dir")
+		writeFile(t, wdir, "dir/file.txt", []byte(tt.local))
+
+		fake := newFakeGCS()
+		fake.put("dir/file.txt", []byte("new content"))
+
+		var logs logLines
+		p := Plugin{
+			Config: Config{
+				Source:           "bucket/dir",
+				Target:           wdir,
+				Download:         true,
+				DownloadExisting: tt.policy,
+				DownloadCompare:  tt.compare,
+			},
+			printf: logs.printf,
+		}
+		err := p.Exec(fake.client(t))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, compare %v: err = %v; wantErr %v", tt.policy, tt.compare, err, tt.wantErr)
+		}
+
+		b, err := os.ReadFile(filepath.Join(wdir, "dir", "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s, compare %v: content = %q; want %q", tt.policy, tt.compare, b, tt.want)
+		}
+
+		skipped := len(logs.with("dir/file.txt: skipped")) == 1
+		if want := tt.policy == downloadSkip && tt.want == tt.local; skipped != want {
+			t.Errorf("%s, compare %v: logged skip %v; want %v", tt.policy, tt.compare, skipped, want)
+		}
+	}
+}
+
+func TestLongObjectNames(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "short.txt", []byte("short"))
+	writeFile(t, wdir, "long.txt", []byte("long"))
+
+	prefix := strings.Repeat("d", 1020)
+
+	var log logLines
+	p := Plugin{
+		Config: Config{Source: wdir, Target: "bucket/" + prefix},
+		printf: log.printf,
+	}
+
+	fake := newFakeGCS()
+	err := p.Exec(fake.client(t))
+	if err == nil || !strings.Contains(err.Error(), "longer than 1024 bytes: long.txt, short.txt") {
+		t.Fatalf("Exec = %v; want object names too long error", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("%d objects uploaded despite the long names", len(fake.objects))
+	}
+
+	p.Config.Target = "bucket/" + prefix
+	p.Config.HashLongNames = true
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec with HashLongNames: %v", err)
+	}
+	if len(fake.objects) != 2 {
+		t.Fatalf("%d objects uploaded; want 2", len(fake.objects))
+	}
+	for name := range fake.objects {
+		if len(name) > 1024 || !strings.HasSuffix(name, ".txt") {
+			t.Errorf("object %q: want at most 1024 bytes with .txt extension", name)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "a", "b")
+	writeFile(t, wdir, "a/b/app.js", []byte("app"))
+	writeFile(t, wdir, "a/site.css", []byte("site"))
+	writeFile(t, wdir, "index.html", []byte("index"))
+
+	p := Plugin{Config: Config{
+		Source:  wdir,
+		Target:  "bucket/dir",
+		Flatten: true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/app.js", "dir/site.css", "dir/index.html"} {
+		if fake.object(name) == nil {
+			t.Errorf("%s was not uploaded", name)
+		}
+	}
+
+	writeFile(t, wdir, "a/index.html", []byte("other index"))
+	writeFile(t, wdir, "a/b/index.html", []byte("another index"))
+
+	p = Plugin{Config: Config{
+		Source:  wdir,
+		Target:  "bucket/dir",
+		Flatten: true,
+	}}
+	err := p.Exec(newFakeGCS().client(t))
+	want := "flattened object names collide: dir/index.html (a/b/index.html, a/index.html, index.html)"
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v; want %s", err, want)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		bucket string
+		prefix string
+		object string
+	}{
+		{"bucket", "bucket", "", "dir/file.txt"},
+		{"bucket/", "bucket", "", "dir/file.txt"},
+		{"/bucket/", "bucket", "", "dir/file.txt"},
+		{"bucket/prefix", "bucket", "prefix", "prefix/dir/file.txt"},
+		{"bucket/prefix/", "bucket", "prefix", "prefix/dir/file.txt"},
+		{"bucket//prefix/sub/", "bucket", "prefix/sub", "prefix/sub/dir/file.txt"},
+	}
+
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "dir")
+	writeFile(t, wdir, "dir/file.txt", []byte("text"))
+
+	for _, tt := range tests {
+		bucket, prefix := parseTarget(tt.target)
+		if bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("parseTarget(%q) = %q, %q; want %q, %q", tt.target, bucket, prefix, tt.bucket, tt.prefix)
+		}
+
+		p := Plugin{Config: Config{Source: wdir, Target: tt.target}}
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%q: %v", tt.target, err)
+		}
+		if fake.object(tt.object) == nil {
+			t.Errorf("%q: %s was not uploaded, got %v", tt.target, tt.object, fake.objects)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	t.Setenv("VERSION", "1.2.3")
+
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "js/app.js", []byte("app"))
+	writeFile(t, wdir, "index.html", []byte("index"))
+
+	p := Plugin{Config: Config{
+		Source: wdir,
+		Target: "bucket/site",
+		Rename: "{dir}/{name}.${VERSION}{ext}",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	var got []string
+	for name := range fake.objects {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+
+	want := []string{"site/index.1.2.3.html", "site/js/app.1.2.3.js"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("objects = %v; want %v", got, want)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "dist", "public", "js")
+	mkdirs(t, wdir, "dist", "publicity")
+	writeFile(t, wdir, "dist/public/app.js", []byte("app"))
+	writeFile(t, wdir, "dist/public/js/lib.js", []byte("lib"))
+	writeFile(t, wdir, "dist/publicity/ad.txt", []byte("ad"))
+
+	for _, flatten := range []bool{false, true} {
+		var logs logLines
+		p := Plugin{
+			Config: Config{
+				Source:      wdir,
+				Target:      "bucket",
+				StripPrefix: "dist/public/",
+				Flatten:     flatten,
+			},
+			printf: logs.printf,
+		}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"app.js", "dist/publicity/ad.txt", "js/lib.js"}
+		if flatten {
+			want = []string{"ad.txt", "app.js", "lib.js"}
+		}
+		var got []string
+		for name := range fake.objects {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("flatten %v: uploaded %v; want %v", flatten, got, want)
+		}
+		if lines := logs.with("warning: dist/publicity/ad.txt "); len(lines) != 1 {
+			t.Errorf("flatten %v: logged %q; want a warning", flatten, lines)
+		}
+	}
+}
+
+func TestVerifyGzip(t *testing.T) {
+	wdir := t.TempDir()
+	content := bytes.Repeat([]byte("compressible content "), 10000)
+	writeFile(t, wdir, "file.txt", content)
+	file := filepath.Join(wdir, "file.txt")
+
+	p := Plugin{Config: Config{
+		Source:     wdir,
+		Target:     "bucket",
+		Gzip:       []string{"txt"},
+		VerifyGzip: true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	obj := fake.object("file.txt")
+	if obj == nil {
+		t.Fatal("file.txt was not uploaded")
+	}
+	if !bytes.Equal(gunzip(t, obj.body), content) {
+		t.Error("uploaded content does not decompress to the file")
+	}
+
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	valid := gz(content)
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"corrupted", corrupted, true},
+		{"truncated", valid[:len(valid)/2], true},
+		{"other content", gz(append(content, '!')), true},
+		{"not gzip", content, true},
+	}
+	for _, tt := range tests {
+		err := verifyGzip(bytes.NewReader(tt.stream), file)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyGzip error = %v; wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBucketPrefix(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	tests := []struct {
+		target string
+		bucket string
+		prefix string
+		object string
+	}{
+		{"bucket/legacy/", "", "", "legacy/file.txt"},
+		{"", "bucket", "/releases/v1/", "releases/v1/file.txt"},
+		{"", "bucket", "", "file.txt"},
+		{"ignored/target", "bucket", "releases", "releases/file.txt"},
+	}
+
+	for _, tt := range tests {
+		p := Plugin{Config: Config{Source: wdir, Target: tt.target, Bucket: tt.bucket, Prefix: tt.prefix}}
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%q, %q, %q: %v", tt.target, tt.bucket, tt.prefix, err)
+		}
+		if fake.object(tt.object) == nil {
+			t.Errorf("%q, %q, %q: %s was not uploaded", tt.target, tt.bucket, tt.prefix, tt.object)
+		}
+	}
+
+	// in download mode the bucket and prefix replace the source
+	ddir := t.TempDir()
+	fake := newFakeGCS()
+	fake.put("releases/v1/file.txt", []byte("text"))
+	fake.put("other/file.txt", []byte("other"))
+
+	p := Plugin{Config: Config{Target: ddir, Bucket: "bucket", Prefix: "releases/", Download: true}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(ddir, "releases", "v1", "file.txt")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(ddir, "other")); !os.IsNotExist(err) {
+		t.Errorf("objects outside of the prefix were downloaded: %v", err)
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	wdir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		writeFile(t, wdir, fmt.Sprintf("file%d.txt", i), []byte("text"))
+	}
+
+	// the fake clock only advances on tick
+	sleeps := make(chan time.Duration)
+	tick := make(chan struct{})
+	p := Plugin{
+		Config: Config{
+			Source:      wdir,
+			Target:      "bucket",
+			Concurrency: 5,
+			RampUp:      4 * time.Second,
+		},
+		sleep: func(d time.Duration) {
+			sleeps <- d
+			<-tick
+		},
+	}
+
+	fake := newFakeGCS()
+	fake.block = make(chan struct{})
+
+	done := make(chan error, 1)
+	go func() { done <- p.Exec(fake.client(t)) }()
+
+	inflight := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.inflight
+	}
+	waitInflight := func(want int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for inflight() < want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if n := inflight(); n != want {
+			t.Fatalf("%d uploads in flight; want %d", n, want)
+		}
+	}
+
+	waitInflight(1)
+	for want := 2; want <= 5; want++ {
+		if d := <-sleeps; d != time.Second {
+			t.Errorf("ramp step = %s; want 1s", d)
+		}
+		tick <- struct{}{}
+		waitInflight(want)
+	}
+
+	close(fake.block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.objects); n != 10 {
+		t.Errorf("uploaded %d files; want 10", n)
+	}
+}
+
+func TestExpectedHashes(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	manifest := filepath.Join(t.TempDir(), "sha256.txt")
+	writeFile(t, filepath.Dir(manifest), "sha256.txt", []byte(
+		"# expected content\n"+
+			"dir/good.txt "+sum("good")+"\n"+
+			"dir/bad.txt "+sum("expected")+"\n"))
+
+	tests := []struct {
+		object  string
+		wantErr bool
+	}{
+		{"dir/good.txt", false},
+		{"dir/bad.txt", true},
+		{"dir/unlisted.txt", true},
+	}
+
+	for _, tt := range tests {
+		wdir := t.TempDir()
+		fake := newFakeGCS()
+		fake.put(tt.object, []byte(strings.TrimSuffix(path.Base(tt.object), ".txt")))
+
+		p := Plugin{Config: Config{
+			Source:         "bucket/dir",
+			Target:         wdir,
+			Download:       true,
+			ExpectedHashes: manifest,
+		}}
+		err := p.Exec(fake.client(t))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v; wantErr %v", tt.object, err, tt.wantErr)
+		}
+
+		_, err = os.Stat(filepath.Join(wdir, filepath.FromSlash(tt.object)))
+		if exists := err == nil; exists == tt.wantErr {
+			t.Errorf("%s: downloaded file exists %v; want %v", tt.object, exists, !tt.wantErr)
+		}
+	}
+
+	// uploads are checked too
+	wdir := t.TempDir()
+	writeFile(t, wdir, "bad.txt", []byte("bad"))
+	hashes, err := readExpectedHashes(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Plugin{bucket: newFakeGCS().client(t).Bucket("bucket"), expectedHashes: hashes}
+	if err := p.uploadFile("dir/bad.txt", filepath.Join(wdir, "bad.txt")); !errors.Is(err, errUnexpectedHash) {
+		t.Errorf("upload err = %v; want %v", err, errUnexpectedHash)
+	}
+}
+
+func TestUploadStdin(t *testing.T) {
+	tests := []struct {
+		target      string
+		gzip        []string
+		contentType string
+		encoding    string
+	}{
+		{"bucket/artifacts/app.tar", nil, "application/octet-stream", ""},
+		{"bucket/artifacts/report.json", []string{"json"}, "application/json", "gzip"},
+	}
+
+	for _, tt := range tests {
+		content := []byte(`{"status": "ok"}`)
+		p := Plugin{
+			Config: Config{
+				Source:         "-",
+				Target:         tt.target,
+				Gzip:           tt.gzip,
+				ContentTypeMap: map[string]string{"json": "application/json"},
+			},
+			stdin: bytes.NewReader(content),
+		}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+
+		name := strings.TrimPrefix(tt.target, "bucket/")
+		obj := fake.object(name)
+		if obj == nil {
+			t.Fatalf("%s was not uploaded", name)
+		}
+		if obj.attrs.ContentType != tt.contentType {
+			t.Errorf("%s: ContentType = %q; want %q", name, obj.attrs.ContentType, tt.contentType)
+		}
+		if obj.attrs.ContentEncoding != tt.encoding {
+			t.Errorf("%s: ContentEncoding = %q; want %q", name, obj.attrs.ContentEncoding, tt.encoding)
+		}
+		body := obj.body
+		if tt.encoding == "gzip" {
+			body = gunzip(t, body)
+		}
+		if !bytes.Equal(body, content) {
+			t.Errorf("%s: content = %q; want %q", name, body, content)
+		}
+	}
+
+	p := Plugin{Config: Config{Source: "-", Target: "bucket/"}, stdin: strings.NewReader("")}
+	if err := p.Exec(newFakeGCS().client(t)); err == nil {
+		t.Error("expected a target without object name to fail")
+	}
+}
+
+func TestUploadStdinDryRun(t *testing.T) {
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:         "-",
+			Target:         "bucket/artifacts/report.json",
+			Gzip:           []string{"json"},
+			ContentTypeMap: map[string]string{"json": "application/json"},
+			DryRun:         true,
+		},
+		stdin:  strings.NewReader(`{"status": "ok"}`),
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.objects) != 0 {
+		t.Errorf("%d objects uploaded; want none", len(fake.objects))
+	}
+	want := "DRY-RUN upload gs://bucket/artifacts/report.json content-type=application/json compression=gzip"
+	if got := logs.with("DRY-RUN"); len(got) != 1 || got[0] != want {
+		t.Errorf("logged %q; want %q", got, want)
+	}
+}
+
+func TestMetadataTemplate(t *testing.T) {
+	t.Setenv("DRONE_COMMIT_SHA", "abc123")
+	t.Setenv("DRONE_BUILD_NUMBER", "42")
+
+	wdir := t.TempDir()
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source: wdir,
+			Target: "bucket",
+			Metadata: map[string]string{
+				"commit": "${DRONE_COMMIT_SHA}",
+				"build":  "#${DRONE_BUILD_NUMBER} of $DRONE_REPO",
+				"price":  "$$5 for ${DRONE_COMMIT_SHA}",
+				"unset":  "[${GCS_TEST_UNSET_VARIABLE}]",
+			},
+		},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("file.txt")
+	if obj == nil {
+		t.Fatal("file.txt was not uploaded")
+	}
+	want := map[string]string{
+		"commit": "abc123",
+		"build":  "#42 of $DRONE_REPO",
+		"price":  "$5 for abc123",
+		"unset":  "[]",
+	}
+	if !reflect.DeepEqual(obj.attrs.Metadata, want) {
+		t.Errorf("Metadata = %v; want %v", obj.attrs.Metadata, want)
+	}
+	if lines := logs.with("warning: metadata unset: GCS_TEST_UNSET_VARIABLE"); len(lines) != 1 {
+		t.Errorf("logged %q; want a warning for the unset variable", logs.lines)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "index.html", []byte("index"))
+	writeFile(t, wdir, "js/app.js", []byte("javascript"))
+
+	p := Plugin{Config: Config{
+		Source:              wdir,
+		Target:              "bucket/site",
+		Manifest:            "meta/manifest.json",
+		ManifestContentType: "application/vnd.manifest+json",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("site/meta/manifest.json")
+	if obj == nil {
+		t.Fatal("manifest was not uploaded")
+	}
+	if obj.attrs.ContentType != "application/vnd.manifest+json" {
+		t.Errorf("ContentType = %q; want application/vnd.manifest+json", obj.attrs.ContentType)
+	}
+
+	var got manifest
+	if err := json.Unmarshal(obj.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := manifest{
+		Bucket: "bucket",
+		Prefix: "site",
+		Objects: []manifestEntry{
+			{Name: "site/index.html", File: "index.html", Size: 5},
+			{Name: "site/js/app.js", File: "js/app.js", Size: 10},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %+v; want %+v", got, want)
+	}
+}
+
+func TestGenerateIndex(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js")
+	writeFile(t, wdir, "index.html", []byte("index"))
+	writeFile(t, wdir, "js/app.js", []byte("javascript"))
+
+	p := Plugin{Config: Config{
+		Source:        wdir,
+		Target:        "bucket/site",
+		GenerateIndex: "index.json",
+		ACL:           []string{"allUsers:READER"},
+		CacheControl:  "public,max-age=60",
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("site/index.json")
+	if obj == nil {
+		t.Fatal("index was not uploaded")
+	}
+	want := []storage.ACLRule{{Entity: "allUsers", Role: "READER"}}
+	if obj.attrs.CacheControl != "public,max-age=60" || !reflect.DeepEqual(obj.attrs.ACL, want) {
+		t.Errorf("index cache control %q, ACL %v; want public,max-age=60 and %v", obj.attrs.CacheControl, obj.attrs.ACL, want)
+	}
+
+	var got []indexEntry
+	if err := json.Unmarshal(obj.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex := []indexEntry{
+		{Name: "site/index.html", Size: 5},
+		{Name: "site/js/app.js", Size: 10},
+	}
+	if !reflect.DeepEqual(got, wantIndex) {
+		t.Errorf("index = %+v; want %+v", got, wantIndex)
+	}
+}
+
+func TestGenerateIndexNoClobber(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "index.html", []byte("index"))
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+
+	fake := newFakeGCS()
+	fake.put("site/app.js", []byte("previous javascript"))
+	fake.put("site/index.json", []byte("[]"))
+
+	for run := 1; run <= 2; run++ {
+		p := Plugin{Config: Config{
+			Source:        wdir,
+			Target:        "bucket/site",
+			GenerateIndex: "index.json",
+			NoClobber:     true,
+			TemporaryHold: true,
+		}}
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+
+	obj := fake.object("site/index.json")
+	if obj.attrs.TemporaryHold {
+		t.Error("index is held")
+	}
+
+	var got []indexEntry
+	if err := json.Unmarshal(obj.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []indexEntry{
+		{Name: "site/app.js", Size: 19},
+		{Name: "site/index.html", Size: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("index = %+v; want %+v", got, want)
+	}
+}
+
+func TestNoGzipGlob(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "js", "vendor")
+	writeFile(t, wdir, "js/app.js", []byte("app"))
+	writeFile(t, wdir, "js/app.min.js", []byte("minified"))
+	writeFile(t, wdir, "js/vendor/lib.js", []byte("lib"))
+
+	p := Plugin{Config: Config{
+		Source:     wdir,
+		Target:     "bucket",
+		Gzip:       []string{"js"},
+		NoGzipGlob: []string{"*/*.min.js", "js/vendor"},
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"js/app.js":        "gzip",
+		"js/app.min.js":    "",
+		"js/vendor/lib.js": "",
+	} {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if obj.attrs.ContentEncoding != want {
+			t.Errorf("%s: ContentEncoding = %q; want %q", name, obj.attrs.ContentEncoding, want)
+		}
+	}
+}
+
+func TestGzipContentTypes(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "data.json", []byte(`{"a": 1}`))
+	writeFile(t, wdir, "LICENSE", []byte("license"))
+	writeFile(t, wdir, "image.png", []byte("png"))
+
+	p := Plugin{Config: Config{
+		Source:             wdir,
+		Target:             "bucket",
+		DefaultContentType: "text/plain; charset=utf-8",
+		GzipContentTypes:   []string{"application/json", "text/plain"},
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"data.json": "gzip",
+		"LICENSE":   "gzip",
+		"image.png": "",
+	} {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if obj.attrs.ContentEncoding != want {
+			t.Errorf("%s: ContentEncoding = %q; want %q", name, obj.attrs.ContentEncoding, want)
+		}
+	}
+}
+
+func TestGzipMinSize(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "small.js", []byte("var a;"))
+	writeFile(t, wdir, "large.js", bytes.Repeat([]byte("var a;\n"), 100))
+
+	p := Plugin{Config: Config{
+		Source:      wdir,
+		Target:      "bucket",
+		Gzip:        []string{"js"},
+		GzipMinSize: 100,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"small.js": "",
+		"large.js": "gzip",
+	} {
+		obj := fake.object(name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", name)
+			continue
+		}
+		if obj.attrs.ContentEncoding != want {
+			t.Errorf("%s: ContentEncoding = %q; want %q", name, obj.attrs.ContentEncoding, want)
+		}
+	}
+	if obj := fake.object("small.js"); obj != nil && string(obj.body) != "var a;" {
+		t.Errorf("small.js body = %q; want it uncompressed", obj.body)
+	}
+}
+
+func TestGzipMinSizeStdin(t *testing.T) {
+	content := bytes.Repeat([]byte("var a;\n"), 10)
+	p := Plugin{
+		Config: Config{
+			Source:      "-",
+			Target:      "bucket/app.js",
+			Gzip:        []string{"js"},
+			GzipMinSize: int64(len(content)) * 2,
+		},
+		stdin: bytes.NewReader(content),
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size of stdin is unknown, it is gzipped whatever it is
+	obj := fake.object("app.js")
+	if obj == nil {
+		t.Fatal("app.js was not uploaded")
+	}
+	if obj.attrs.ContentEncoding != "gzip" {
+		t.Errorf("ContentEncoding = %q; want gzip", obj.attrs.ContentEncoding)
+	}
+}
+
+func TestGzipMinSizeBrotliWarning(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:      wdir,
+			Target:      "bucket",
+			Gzip:        []string{"js"},
+			Brotli:      []string{"js"},
+			GzipMinSize: 1024,
+		},
+		printf: logs.printf,
+	}
+
+	if err := p.Exec(newFakeGCS().client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logs.with("warning: js")) != 1 {
+		t.Errorf("no warning logged for js in both lists: %q", logs.lines)
+	}
+}
+
+func TestWalkFilesSorted(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "a")
+	mkdirs(t, wdir, "lib")
+	for _, name := range []string{"b.txt", "a/z.txt", "a.txt", "C.txt", "a-b.txt"} {
+		writeFile(t, wdir, name, []byte(name))
+	}
+	if err := os.Symlink(filepath.Join(wdir, "a"), filepath.Join(wdir, "lib", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Plugin{Config: Config{Source: wdir, Symlinks: symlinksFollow}, printf: func(string, ...interface{}) {}}
+	files, err := p.walkFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range files {
+		rel, _ := filepath.Rel(wdir, f)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{"C.txt", "a-b.txt", "a.txt", "a/z.txt", "b.txt", "lib/link/z.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkFiles = %q; want %q", got, want)
+	}
+}
+
+func TestSkipHidden(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, ".git")
+	mkdirs(t, wdir, "css")
+	writeFile(t, wdir, ".git/config", []byte("config"))
+	writeFile(t, wdir, ".DS_Store", []byte("store"))
+	writeFile(t, wdir, "css/.site.css.swp", []byte("swap"))
+	writeFile(t, wdir, "css/site.css", []byte("style"))
+	writeFile(t, wdir, "index.html", []byte("html"))
+
+	for _, skip := range []bool{false, true} {
+		p := Plugin{Config: Config{Source: wdir, Target: "bucket", SkipHidden: skip}}
+
+		fake := newFakeGCS()
+		if err := p.Exec(fake.client(t)); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for name := range fake.objects {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+
+		want := []string{".DS_Store", ".git/config", "css/.site.css.swp", "css/site.css", "index.html"}
+		if skip {
+			want = []string{"css/site.css", "index.html"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("skip hidden %v: uploaded %q; want %q", skip, got, want)
+		}
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "my app.js", []byte("javascript"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{
+			Source:        wdir,
+			Target:        "bucket/dir",
+			PredefinedACL: "publicRead",
+			PublicURL:     true,
+			Manifest:      "manifest.json",
+		},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "https://storage.googleapis.com/bucket/dir/my%20app.js"
+	if got := logs.with("my app.js: "); !reflect.DeepEqual(got, []string{"my app.js: " + want}) {
+		t.Errorf("logged %q; want the public URL %s", got, want)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(fake.object("dir/manifest.json").body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Objects) != 1 || m.Objects[0].URL != want {
+		t.Errorf("manifest objects = %+v; want the public URL %s", m.Objects, want)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "part-1", []byte("first,"))
+	writeFile(t, wdir, "part-2", []byte("second,"))
+	writeFile(t, wdir, "part-3", []byte("third"))
+
+	p := Plugin{Config: Config{
+		Source:  wdir,
+		Target:  "bucket/release/app.txt",
+		Compose: true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("release/app.txt")
+	if obj == nil {
+		t.Fatal("composed object not created")
+	}
+	if string(obj.body) != "first,second,third" {
+		t.Errorf("composed object = %q; want the parts in order", obj.body)
+	}
+	if !strings.HasPrefix(obj.attrs.ContentType, "text/plain") {
+		t.Errorf("content type = %q; want text/plain", obj.attrs.ContentType)
+	}
+	if len(fake.objects) != 1 {
+		t.Errorf("%d objects left; want the parts deleted", len(fake.objects))
+	}
+
+	for i := 0; i < maxComposeSources; i++ {
+		writeFile(t, wdir, fmt.Sprintf("extra-%d", i), []byte("x"))
+	}
+	p = Plugin{Config: Config{Source: wdir, Target: "bucket/app.txt", Compose: true}}
+	if err := p.Exec(fake.client(t)); err == nil || !strings.Contains(err.Error(), "GCS composes at most 32 objects") {
+		t.Errorf("err = %v; want the compose limit exceeded", err)
+	}
+}
+
+func TestComposeAttributes(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "part-1", []byte("first,"))
+	writeFile(t, wdir, "part-2", []byte("second"))
+
+	fake := newFakeGCS()
+	fake.put("release/app.txt.part-0", []byte("user object"))
+	// the first part upload is retried
+	fake.uploadErrors = []int{http.StatusServiceUnavailable}
+
+	var logs logLines
+	config := Config{
+		Source:        wdir,
+		Target:        "bucket/release/app.txt",
+		Compose:       true,
+		ACL:           []string{"allUsers:READER"},
+		CacheControl:  "public,max-age=60",
+		StorageClass:  "NEARLINE",
+		TemporaryHold: true,
+		NoClobber:     true,
+		Retries:       1,
+	}
+	p := Plugin{Config: config, printf: logs.printf, sleep: func(time.Duration) {}}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("release/app.txt")
+	if obj == nil {
+		t.Fatal("composed object not created")
+	}
+	if string(obj.body) != "first,second" {
+		t.Errorf("composed object = %q; want the parts in order", obj.body)
+	}
+	want := []storage.ACLRule{{Entity: "allUsers", Role: "READER"}}
+	if !reflect.DeepEqual(obj.attrs.ACL, want) || obj.attrs.CacheControl != "public,max-age=60" ||
+		obj.attrs.StorageClass != "NEARLINE" || !obj.attrs.TemporaryHold {
+		t.Errorf("composed object ACL %v, cache control %q, storage class %q, temporary hold %v; want those of the config",
+			obj.attrs.ACL, obj.attrs.CacheControl, obj.attrs.StorageClass, obj.attrs.TemporaryHold)
+	}
+	if user := fake.object("release/app.txt.part-0"); user == nil || string(user.body) != "user object" {
+		t.Error("object named like a part was overwritten or deleted")
+	}
+	if len(fake.objects) != 2 {
+		t.Errorf("%d objects left; want the parts deleted", len(fake.objects))
+	}
+	if len(logs.with("release/.compose-")) != 1 {
+		t.Errorf("logged %q; want the failed part upload retried", logs.lines)
+	}
+
+	// with no-clobber the composed object is kept
+	writeFile(t, wdir, "part-2", []byte("changed"))
+	p = Plugin{Config: config, printf: logs.printf}
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.object("release/app.txt"); string(obj.body) != "first,second" {
+		t.Errorf("composed object = %q; want it kept", obj.body)
+	}
+	if len(logs.with("release/app.txt: skipped")) != 1 {
+		t.Errorf("logged %q; want the composed object skipped", logs.lines)
+	}
+}
+
+func TestComposeDeleteSource(t *testing.T) {
+	wdir := t.TempDir()
+	mkdirs(t, wdir, "parts")
+	writeFile(t, wdir, "parts/part-1", []byte("first,"))
+	writeFile(t, wdir, "parts/part-2", []byte("second"))
+
+	p := Plugin{Config: Config{
+		Source:         wdir,
+		Target:         "bucket/app.txt",
+		Compose:        true,
+		DeleteSource:   true,
+		PruneEmptyDirs: true,
+	}}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj := fake.object("app.txt"); obj == nil || string(obj.body) != "first,second" {
+		t.Fatal("composed object not created")
+	}
+	if _, err := os.Stat(filepath.Join(wdir, "parts")); !os.IsNotExist(err) {
+		t.Errorf("parts directory left: %v", err)
+	}
+}
+
+func TestComposeBreakerCleanup(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "part-1", []byte("first,"))
+	writeFile(t, wdir, "part-2", []byte("second"))
+
+	// the upload of the second part always fails,
+	// the requests of cancelled contexts too
+	fake := newFakeGCS()
+	hc := &http.Client{Transport: &fakeTransport{func(r *http.Request) (*http.Response, error) {
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(r.URL.Query().Get("name"), "/part-1") {
+			return fakeResponse(http.StatusServiceUnavailable, `{"error": {"code": 503, "message": "unavailable"}}`), nil
+		}
+		return fake.roundTrip(r)
+	}}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Plugin{
+		Config: Config{
+			Source:               wdir,
+			Target:               "bucket/app.txt",
+			Compose:              true,
+			DisableClientRetries: true,
+			Retries:              3,
+			MaxRetriesPerBucket:  1,
+		},
+		sleep: func(time.Duration) {},
+	}
+	if err := p.Exec(client); err == nil {
+		t.Fatal("expected the part upload to fail")
+	}
+
+	if len(fake.objects) != 0 {
+		t.Errorf("%d objects left; want the uploaded part deleted once the breaker tripped", len(fake.objects))
+	}
+}
+
+func TestLogHashes(t *testing.T) {
+	wdir := t.TempDir()
+	writeFile(t, wdir, "app.js", []byte("javascript"))
+	writeFile(t, wdir, "file.txt", []byte("text"))
+
+	var logs logLines
+	p := Plugin{
+		Config: Config{Source: wdir, Target: "bucket", Gzip: []string{"js"}, LogHashes: true},
+		printf: logs.printf,
+	}
+
+	fake := newFakeGCS()
+	if err := p.Exec(fake.client(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"app.js", "file.txt"} {
+		body := fake.object(name).body
+		sum := md5.Sum(body)
+		want := fmt.Sprintf("%s: crc32c=%08x md5=%x", name, crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)), sum)
+		if name == "app.js" {
+			want += " (of the gzip compressed content)"
+		}
+
+		if got := logs.with(name + ": crc32c="); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("logged %q; want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is the interval between the progress logs of an upload.
+const progressInterval = 5 * time.Second
+
+// progressReader counts the bytes read from r, the content uploaded
+// to the object name, logging the progress every progressInterval
+// and once the content is read.
+type progressReader struct {
+	r    io.Reader
+	p    *Plugin
+	name string
+
+	start time.Time
+	last  time.Time
+	n     int64
+}
+
+// newProgressReader returns r counting the bytes uploaded to the object name.
+func (p *Plugin) newProgressReader(r io.Reader, name string) *progressReader {
+	now := time.Now()
+	return &progressReader{r: r, p: p, name: name, start: now, last: now}
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.n += int64(n)
+	pr.p.transferred.Add(int64(n))
+
+	now := time.Now()
+
+	switch {
+	case err == io.EOF:
+		pr.p.printf("%s: %d bytes uploaded, %s", pr.name, pr.n, throughput(pr.n, now.Sub(pr.start)))
+	case now.Sub(pr.last) >= progressInterval:
+		pr.last = now
+		pr.p.printf("%s: %d bytes uploaded so far, %s", pr.name, pr.n, throughput(pr.n, now.Sub(pr.start)))
+	}
+
+	return n, err
+}
+
+// discard takes the bytes counted by pr out of the bytes uploaded by the run.
+func (pr *progressReader) discard() {
+	pr.p.transferred.Add(-pr.n)
+}
+
+// logProgress logs the total bytes uploaded by the run, which took elapsed.
+func (p *Plugin) logProgress(elapsed time.Duration) {
+	n := p.transferred.Load()
+	p.printf("progress: %d bytes uploaded in %s, %s", n, elapsed.Round(time.Millisecond), throughput(n, elapsed))
+}
+
+// throughput formats the rate of n bytes transferred in d, in MB/s.
+func throughput(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "- MB/s"
+	}
+
+	return fmt.Sprintf("%.2f MB/s", float64(n)/(1024*1024)/d.Seconds())
+}
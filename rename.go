@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// renameTokenPattern matches the {token} placeholders of a rename template,
+// and the ${VAR} ones, which are left to the environment.
+var renameTokenPattern = regexp.MustCompile(`\$?\{([^{}]*)\}`)
+
+// renameTokens are the placeholders of a rename template.
+var renameTokens = map[string]bool{
+	"path": true, // path relative to source, e.g. js/app.js
+	"dir":  true, // directory of the path, e.g. js
+	"base": true, // last element of the path, e.g. app.js
+	"name": true, // last element without its extension, e.g. app
+	"ext":  true, // extension including the dot, e.g. .js
+}
+
+// validateRename returns an error listing the unknown tokens of the template.
+func validateRename(tmpl string) error {
+	var unknown []string
+
+	for _, m := range renameTokenPattern.FindAllStringSubmatch(tmpl, -1) {
+		if !strings.HasPrefix(m[0], "$") && !renameTokens[m[1]] {
+			unknown = append(unknown, m[0])
+		}
+	}
+
+	if len(unknown) > 0 {
+		return errors.Errorf("Invalid rename template %q, unknown %s", tmpl, strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// rename returns the name of the file at rel, relative to source,
+// given by the p.Rename template.
+func (p *Plugin) rename(rel string) (string, error) {
+	base := path.Base(rel)
+	ext := path.Ext(base)
+
+	name := strings.NewReplacer(
+		"{path}", rel,
+		"{dir}", path.Dir(rel),
+		"{base}", base,
+		"{name}", strings.TrimSuffix(base, ext),
+		"{ext}", ext,
+	).Replace(p.Config.Rename)
+
+	if strings.Trim(name, "/.") == "" {
+		return "", errors.Errorf("%s: renamed to an empty name", rel)
+	}
+
+	return path.Clean(strings.TrimLeft(name, "/")), nil
+}
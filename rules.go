@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// rule is an entry of the rules file, uploading the files of a source
+// with its own options. Options left out keep the value of the plugin
+// config, an empty list clears it.
+type rule struct {
+	Source       string    `json:"source"`
+	Target       string    `json:"target"`
+	Include      string    `json:"include"`
+	Ignore       string    `json:"ignore"`
+	ACL          *[]string `json:"acl"`
+	Gzip         *[]string `json:"gzip"`
+	CacheControl *string   `json:"cache_control"`
+}
+
+// readRules reads and validates the JSON array of rules of file.
+func readRules(file string) ([]rule, error) {
+	b, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading rules file")
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	var rules []rule
+
+	if err := d.Decode(&rules); err != nil {
+		return nil, errors.Wrap(err, "error parsing rules file")
+	}
+
+	if len(rules) == 0 {
+		return nil, errors.New("rules file has no rules")
+	}
+
+	for i, r := range rules {
+		if r.ACL != nil {
+			if _, err := parseACLs(*r.ACL); err != nil {
+				return nil, errors.Wrapf(err, "rule %d", i+1)
+			}
+		}
+
+		for _, pattern := range splitPatterns(r.Include + "," + r.Ignore) {
+			if err := validatePattern(strings.TrimSuffix(pattern, "/")); err != nil {
+				return nil, errors.Wrapf(err, "rule %d: invalid pattern", i+1)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// config returns c with the options of the rule applied.
+func (r rule) config(c Config) Config {
+	if r.Source != "" {
+		c.Source = r.Source
+	}
+
+	if r.Target != "" {
+		c.Target = r.Target
+	}
+
+	if r.Include != "" {
+		c.Include = r.Include
+	}
+
+	if r.Ignore != "" {
+		c.Ignore = r.Ignore
+	}
+
+	if r.ACL != nil {
+		c.ACL = *r.ACL
+	}
+
+	if r.Gzip != nil {
+		c.Gzip = append([]string(nil), *r.Gzip...)
+	}
+
+	if r.CacheControl != nil {
+		c.CacheControl = *r.CacheControl
+	}
+
+	return c
+}
+
+// execRules uploads the files of every rule of p.RulesFile in turn,
+// each run with the plugin config overridden by the rule.
+func (p *Plugin) execRules(client *storage.Client) error {
+	if p.Config.Download {
+		return errors.New("rules file is not supported in download mode")
+	}
+
+	rules, err := readRules(p.Config.RulesFile)
+
+	if err != nil {
+		return err
+	}
+
+	for i, r := range rules {
+		c := r.config(p.Config)
+
+		if c.Source == "" || (c.Target == "" && c.Bucket == "") {
+			return errors.Errorf("rule %d: missing source or target", i+1)
+		}
+
+		if err := p.execWith(client, c); err != nil {
+			return errors.Wrapf(err, "rule %d", i+1)
+		}
+	}
+
+	return nil
+}
+
+// execWith runs the plugin with the config c instead of p.Config,
+// adding the results to those of p. The failures which would exit
+// the process are returned instead, for the other runs to go on.
+func (p *Plugin) execWith(client *storage.Client, c Config) error {
+	sub := &Plugin{
+		Config: c,
+		stdin:  p.stdin,
+		stdout: p.stdout,
+		sleep:  p.sleep,
+		printf: p.printf,
+	}
+
+	sub.fatalf = func(format string, args ...interface{}) {
+		if sub.fatal == nil {
+			sub.fatal = errors.Errorf(format, args...)
+		}
+	}
+
+	err := sub.exec(client)
+
+	p.summary.Uploaded += sub.summary.Uploaded
+	p.summary.Skipped += sub.summary.Skipped
+	p.summary.Failed += sub.summary.Failed
+	p.summary.Bytes += sub.summary.Bytes
+	p.transferred.Add(sub.transferred.Load())
+
+	if code := sub.exitCode(); code != 0 {
+		p.ecodeMu.Lock()
+		p.ecode = code
+		p.ecodeMu.Unlock()
+	}
+
+	return err
+}
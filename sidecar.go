@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// aclSidecarExt is the extension of the sidecar holding the ACL of the file
+// it is named after. A sidecar named only .acl holds the ACL of the files
+// of its directory and subdirectories.
+const aclSidecarExt = ".acl"
+
+// isACLSidecar reports whether path is an ACL sidecar.
+func isACLSidecar(path string) bool {
+	return filepath.Ext(path) == aclSidecarExt
+}
+
+// fileACL returns the ACL of the object uploaded from file.
+//
+// The rules of the nearest sidecar are applied over those of aclRules:
+// the sidecar of the file itself, else the one of its directory or of
+// the closest parent directory within p.Source.
+func (p *Plugin) fileACL(file string) ([]storage.ACLRule, error) {
+	base, baseACL := p.aclRules(file)
+	sidecar, rules, err := p.sidecarACL(file)
+
+	if err != nil || sidecar == "" {
+		return baseACL, err
+	}
+
+	acl, err := parseACLs(append(append([]string(nil), base...), rules...))
+
+	if err != nil {
+		return nil, errors.Wrap(err, sidecar)
+	}
+
+	return acl, nil
+}
+
+// sidecarACL returns the path and rules of the nearest ACL sidecar of file,
+// or an empty path when there is none.
+func (p *Plugin) sidecarACL(file string) (string, []string, error) {
+	candidates := []string{file + aclSidecarExt}
+
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		candidates = append(candidates, filepath.Join(dir, aclSidecarExt))
+
+		if rel, err := filepath.Rel(p.Config.Source, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			break
+		}
+	}
+
+	for _, sidecar := range candidates {
+		b, err := os.ReadFile(sidecar)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return "", nil, errors.Wrap(err, "error reading ACL sidecar")
+		}
+
+		return sidecar, readACLSidecar(b), nil
+	}
+
+	return "", nil, nil
+}
+
+// readACLSidecar returns the entity:role rules of a sidecar, one per line.
+// Blank lines and lines starting with # are skipped.
+func readACLSidecar(b []byte) []string {
+	var rules []string
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rules = append(rules, line)
+	}
+
+	return rules
+}
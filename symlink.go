@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Policies applied to the symbolic links found under the source.
+const (
+	symlinksSkip   = "skip"
+	symlinksFollow = "follow"
+	symlinksError  = "error"
+)
+
+// resolveSymlink returns the file info of the target of the symbolic link
+// at path, rel being relative to the source, or nil if the link is skipped
+// according to p.Symlinks.
+//
+// Broken links and links to one of the directories walked down to them,
+// through the links followed, are skipped with a warning when followed.
+// Links to a directory containing them, or to each other, would be
+// walked forever.
+func (p *Plugin) resolveSymlink(path, rel string) (os.FileInfo, error) {
+	switch p.Config.Symlinks {
+	case symlinksFollow:
+	case symlinksError:
+		return nil, errors.Errorf("%s: symbolic links are not allowed", rel)
+	default:
+		p.printf("%s: skipped, symbolic link", rel)
+		return nil, nil
+	}
+
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		p.printf("warning: %s: skipped, broken symbolic link", rel)
+		return nil, nil
+	}
+
+	if !fi.IsDir() {
+		return fi, nil
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	walked, err := p.walkedDirs(rel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if walked[target] {
+		p.printf("warning: %s: skipped, symbolic link to %s would loop", rel, target)
+		return nil, nil
+	}
+
+	return fi, nil
+}
+
+// walkedDirs returns the real paths of the directories walked down to rel,
+// relative to the source, from the source itself.
+func (p *Plugin) walkedDirs(rel string) (map[string]bool, error) {
+	walked := make(map[string]bool)
+
+	for dir := filepath.Dir(rel); ; dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(filepath.Join(p.Config.Source, dir))
+
+		if err != nil {
+			return nil, err
+		}
+
+		walked[real] = true
+
+		if dir == "." {
+			return walked, nil
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// splitTargets returns the targets of a comma separated list.
+func splitTargets(target string) []string {
+	var targets []string
+
+	for _, t := range strings.Split(target, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+
+	return targets
+}
+
+// execTargets uploads the files to each of targets in turn. A failing
+// target is reported and the upload goes on with the next ones.
+//
+// With p.DeleteSource the files are only deleted by the last target,
+// once uploaded to every other one.
+func (p *Plugin) execTargets(client *storage.Client, targets []string) error {
+	var failed []string
+
+	for i, target := range targets {
+		c := p.Config
+		c.Target = target
+
+		last := i == len(targets)-1
+		c.DeleteSource = p.Config.DeleteSource && last && len(failed) == 0
+
+		if p.Config.DeleteSource && last && len(failed) > 0 {
+			p.printf("delete-source: source files kept, not uploaded to every target")
+		}
+
+		if err := p.execWith(client, c); err != nil {
+			p.errorf("target %s: %v", target, err)
+			failed = append(failed, target)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d targets failed: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
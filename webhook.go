@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultWebhookTimeout is the time allowed to post to the webhook
+// when Config.WebhookTimeout is not set.
+const defaultWebhookTimeout = 10 * time.Second
+
+// summary is the outcome of a run, posted to the webhook.
+type summary struct {
+	Target   string  `json:"target"`
+	Status   string  `json:"status"` // success or failure
+	Error    string  `json:"error,omitempty"`
+	Uploaded int     `json:"uploaded"`
+	Skipped  int     `json:"skipped"`
+	Failed   int     `json:"failed"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// notify posts the summary of the run to p.WebhookURL.
+// The run failed with runErr when it is not nil.
+func (p *Plugin) notify(elapsed time.Duration, runErr error) error {
+	s := p.summary
+	s.Status = "success"
+	s.Duration = elapsed.Seconds()
+
+	if runErr != nil {
+		s.Status = "failure"
+		s.Error = runErr.Error()
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	timeout := p.Config.WebhookTimeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Config.WebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}